@@ -0,0 +1,157 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/pkg/errors"
+)
+
+const (
+	authWorkloadIdentity  = "workload_identity"
+	authManagedIdentity   = "managed_identity"
+	authClientSecret      = "client_secret"
+	authClientCertificate = "client_certificate"
+	authAzureCli          = "azure_cli"
+	authDefault           = "default"
+)
+
+// authConfig holds the settings of the credential of an output. It contains secrets, so it is not part of AzureConfig, which is logged.
+type authConfig struct {
+	Method                    string
+	ClientId                  string
+	TenantId                  string
+	ClientSecret              string
+	ClientCertificate         string
+	ClientCertificatePassword string
+	ManagedIdentityResourceId string
+	TokenFile                 string
+}
+
+// parseAuthConfig reads the authentication keys of an output using get and validates them for the configured AuthMethod.
+func parseAuthConfig(get func(key string) string) (authConfig, error) {
+	auth := authConfig{
+		Method:                    get("authMethod"),
+		ClientId:                  get("clientId"),
+		TenantId:                  get("tenantId"),
+		ClientSecret:              get("clientSecret"),
+		ClientCertificate:         get("clientCertificate"),
+		ClientCertificatePassword: get("clientCertificatePassword"),
+		ManagedIdentityResourceId: get("managedIdentityResourceId"),
+		TokenFile:                 get("tokenFile"),
+	}
+	switch auth.Method {
+	case "":
+		auth.Method = authDefault
+	case authDefault, authWorkloadIdentity, authAzureCli:
+	case authManagedIdentity:
+		if auth.ClientId != "" && auth.ManagedIdentityResourceId != "" {
+			return authConfig{}, errors.New("managed_identity accepts either ClientId or ManagedIdentityResourceId, not both")
+		}
+	case authClientSecret:
+		if auth.ClientId == "" || auth.TenantId == "" || auth.ClientSecret == "" {
+			return authConfig{}, errors.New("client_secret requires ClientId, TenantId and ClientSecret")
+		}
+	case authClientCertificate:
+		if auth.ClientId == "" || auth.TenantId == "" || auth.ClientCertificate == "" {
+			return authConfig{}, errors.New("client_certificate requires ClientId, TenantId and ClientCertificate")
+		}
+	default:
+		return authConfig{}, fmt.Errorf("unknown AuthMethod %q, expected %s, %s, %s, %s, %s or %s", auth.Method,
+			authWorkloadIdentity, authManagedIdentity, authClientSecret, authClientCertificate, authAzureCli, authDefault)
+	}
+	return auth, nil
+}
+
+// newCredential creates the credential for the configured AuthMethod, sending its requests with clientOptions.
+// The ClientId, TenantId and TokenFile of the output take precedence over the AZURE_CLIENT_ID, AZURE_TENANT_ID and
+// AZURE_FEDERATED_TOKEN_FILE environment variables, which are shared by all outputs of the process.
+func newCredential(auth authConfig, clientOptions azcore.ClientOptions) (azcore.TokenCredential, error) {
+	switch auth.Method {
+	case authWorkloadIdentity:
+		return newWorkloadIdentityCredential(auth, clientOptions)
+	case authManagedIdentity:
+		options := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: clientOptions}
+		if auth.ClientId != "" {
+			options.ID = azidentity.ClientID(auth.ClientId)
+		} else if auth.ManagedIdentityResourceId != "" {
+			options.ID = azidentity.ResourceID(auth.ManagedIdentityResourceId)
+		}
+		return azidentity.NewManagedIdentityCredential(options)
+	case authClientSecret:
+		return azidentity.NewClientSecretCredential(auth.TenantId, auth.ClientId, auth.ClientSecret,
+			&azidentity.ClientSecretCredentialOptions{ClientOptions: clientOptions})
+	case authClientCertificate:
+		// The certificate is read when the credential is created, so a certificate that is mounted later is picked up by the retries.
+		data, err := os.ReadFile(auth.ClientCertificate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read client certificate %s", auth.ClientCertificate)
+		}
+		var password []byte
+		if auth.ClientCertificatePassword != "" {
+			password = []byte(auth.ClientCertificatePassword)
+		}
+		certs, key, err := azidentity.ParseCertificates(data, password)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse client certificate %s", auth.ClientCertificate)
+		}
+		return azidentity.NewClientCertificateCredential(auth.TenantId, auth.ClientId, certs, key,
+			&azidentity.ClientCertificateCredentialOptions{ClientOptions: clientOptions})
+	case authAzureCli:
+		return azidentity.NewAzureCLICredential(&azidentity.AzureCLICredentialOptions{TenantID: auth.TenantId})
+	default:
+		if auth.ClientId == "" && auth.TokenFile == "" {
+			return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{ClientOptions: clientOptions, TenantID: auth.TenantId})
+		}
+		return newInstanceIdentityCredential(auth, clientOptions)
+	}
+}
+
+func newWorkloadIdentityCredential(auth authConfig, clientOptions azcore.ClientOptions) (*azidentity.WorkloadIdentityCredential, error) {
+	return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+		ClientOptions: clientOptions,
+		ClientID:      auth.ClientId,
+		TenantID:      auth.TenantId,
+		TokenFilePath: auth.TokenFile,
+	})
+}
+
+// newInstanceIdentityCredential replaces the default chain when the output has its own identity, as that chain only reads
+// the identity from the environment. It tries workload identity and then the managed identity with the client id of the output.
+func newInstanceIdentityCredential(auth authConfig, clientOptions azcore.ClientOptions) (azcore.TokenCredential, error) {
+	var sources []azcore.TokenCredential
+	workloadIdentity, workloadErr := newWorkloadIdentityCredential(auth, clientOptions)
+	if workloadErr == nil {
+		sources = append(sources, workloadIdentity)
+	}
+	if auth.ClientId != "" {
+		managedIdentity, err := azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+			ClientOptions: clientOptions,
+			ID:            azidentity.ClientID(auth.ClientId),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create managed identity credential")
+		}
+		sources = append(sources, managedIdentity)
+	}
+	if len(sources) == 0 {
+		return nil, errors.Wrap(workloadErr, "failed to create workload identity credential")
+	}
+	return azidentity.NewChainedTokenCredential(sources, nil)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/stretchr/testify/assert"
+)
+
+func authKeys(keys map[string]string) func(string) string {
+	return func(key string) string {
+		return keys[key]
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its private key as PEM.
+func writeTestCertificate(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fluent-bit"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	encodedKey, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "client.pem")
+	content := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encodedKey})...)
+	assert.NoError(t, os.WriteFile(path, content, 0600))
+	return path
+}
+
+func TestParseAuthConfig_defaultsToDefaultCredential(t *testing.T) {
+	auth, err := parseAuthConfig(authKeys(nil))
+
+	assert.NoError(t, err)
+	assert.Equal(t, authDefault, auth.Method)
+}
+
+func TestParseAuthConfig_validatesRequiredKeys(t *testing.T) {
+	invalid := []map[string]string{
+		{"authMethod": "certificate"},
+		{"authMethod": "client_secret", "clientId": "client", "tenantId": "tenant"},
+		{"authMethod": "client_certificate", "clientId": "client", "clientSecret": "secret"},
+		{"authMethod": "managed_identity", "clientId": "client", "managedIdentityResourceId": "/subscriptions/x"},
+	}
+	for _, keys := range invalid {
+		_, err := parseAuthConfig(authKeys(keys))
+
+		assert.Error(t, err, keys)
+	}
+}
+
+func TestNewCredential_createsCredentialForMethod(t *testing.T) {
+	t.Setenv("AZURE_CLIENT_ID", "client")
+	t.Setenv("AZURE_TENANT_ID", "tenant")
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", filepath.Join(t.TempDir(), "token"))
+	certificate := writeTestCertificate(t)
+	tests := []struct {
+		keys     map[string]string
+		expected azcore.TokenCredential
+	}{
+		{map[string]string{"authMethod": "workload_identity"}, &azidentity.WorkloadIdentityCredential{}},
+		{map[string]string{"authMethod": "managed_identity", "clientId": "client"}, &azidentity.ManagedIdentityCredential{}},
+		{map[string]string{"authMethod": "managed_identity", "managedIdentityResourceId": "/subscriptions/x"}, &azidentity.ManagedIdentityCredential{}},
+		{map[string]string{"authMethod": "client_secret", "clientId": "client", "tenantId": "tenant", "clientSecret": "secret"}, &azidentity.ClientSecretCredential{}},
+		{map[string]string{"authMethod": "client_certificate", "clientId": "client", "tenantId": "tenant", "clientCertificate": certificate}, &azidentity.ClientCertificateCredential{}},
+		{map[string]string{"authMethod": "azure_cli"}, &azidentity.AzureCLICredential{}},
+		{map[string]string{}, &azidentity.DefaultAzureCredential{}},
+	}
+	for _, test := range tests {
+		auth, err := parseAuthConfig(authKeys(test.keys))
+		assert.NoError(t, err)
+
+		cred, err := newCredential(auth, azcore.ClientOptions{})
+
+		assert.NoError(t, err, test.keys)
+		assert.IsType(t, test.expected, cred, test.keys)
+	}
+}
+
+func TestNewCredential_missingCertificate_returnsError(t *testing.T) {
+	auth := authConfig{Method: authClientCertificate, ClientId: "client", TenantId: "tenant", ClientCertificate: "/does/not/exist.pem"}
+
+	_, err := newCredential(auth, azcore.ClientOptions{})
+
+	assert.Error(t, err)
+}
+
+// fakeAuthority answers the metadata and token requests of Azure AD and records the submitted token requests.
+type fakeAuthority struct {
+	mutex    sync.Mutex
+	requests []url.Values
+}
+
+func (a *fakeAuthority) Do(req *http.Request) (*http.Response, error) {
+	body := `{}`
+	switch {
+	case strings.Contains(req.URL.Path, "openid-configuration"):
+		tenant := strings.Split(strings.Trim(req.URL.Path, "/"), "/")[0]
+		body = fmt.Sprintf(`{"token_endpoint":"https://login.microsoftonline.com/%[1]s/oauth2/v2.0/token","authorization_endpoint":"https://login.microsoftonline.com/%[1]s/oauth2/v2.0/authorize","issuer":"https://login.microsoftonline.com/%[1]s/v2.0"}`, tenant)
+	case strings.HasSuffix(req.URL.Path, "/token"):
+		_ = req.ParseForm()
+		a.mutex.Lock()
+		a.requests = append(a.requests, req.PostForm)
+		a.mutex.Unlock()
+		body = `{"access_token":"token","expires_in":3600,"token_type":"Bearer"}`
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}}, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+func TestNewCredential_instanceIdentity_overridesEnvironment(t *testing.T) {
+	t.Setenv("AZURE_CLIENT_ID", "environment-client")
+	t.Setenv("AZURE_TENANT_ID", "environment-tenant")
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", filepath.Join(t.TempDir(), "missing"))
+	authority := &fakeAuthority{}
+	options := azcore.ClientOptions{Transport: authority}
+	for _, instance := range []string{"a", "b"} {
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		assert.NoError(t, os.WriteFile(tokenFile, []byte("assertion-"+instance), 0600))
+		for _, method := range []string{authWorkloadIdentity, authDefault} {
+			auth, err := parseAuthConfig(authKeys(map[string]string{
+				"authMethod": method, "clientId": "client-" + instance, "tenantId": "tenant-" + instance, "tokenFile": tokenFile,
+			}))
+			assert.NoError(t, err)
+			cred, err := newCredential(auth, options)
+			assert.NoError(t, err)
+
+			_, err = cred.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{tokenScope(cloud.AzurePublic)}})
+
+			assert.NoError(t, err, method)
+		}
+	}
+
+	assert.Len(t, authority.requests, 4)
+	for idx, instance := range []string{"a", "a", "b", "b"} {
+		assert.Equal(t, "client-"+instance, authority.requests[idx].Get("client_id"))
+		assert.Equal(t, "assertion-"+instance, authority.requests[idx].Get("client_assertion"))
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+)
+
+const (
+	cloudPublic     = "AzurePublic"
+	cloudGovernment = "AzureGovernment"
+	cloudChina      = "AzureChina"
+)
+
+// parseCloud returns the cloud configuration used to authenticate and upload, with the authority host and
+// audience overridden when they are set.
+func parseCloud(name string, authorityHost string, audience string) (cloud.Configuration, error) {
+	var base cloud.Configuration
+	switch strings.ToLower(name) {
+	case "", strings.ToLower(cloudPublic), "azurecloud":
+		base = cloud.AzurePublic
+	case strings.ToLower(cloudGovernment), "azureusgovernment":
+		base = cloud.AzureGovernment
+	case strings.ToLower(cloudChina), "azurechinacloud":
+		base = cloud.AzureChina
+	default:
+		return cloud.Configuration{}, fmt.Errorf("unknown cloud %q, expected %s, %s or %s", name, cloudPublic, cloudGovernment, cloudChina)
+	}
+	// The configurations of the SDK are shared globals, so they are copied before they are changed.
+	config := cloud.Configuration{
+		ActiveDirectoryAuthorityHost: base.ActiveDirectoryAuthorityHost,
+		Services:                     maps.Clone(base.Services),
+	}
+	if authorityHost != "" {
+		config.ActiveDirectoryAuthorityHost = authorityHost
+	}
+	if audience != "" {
+		service := config.Services[azlogs.ServiceNameIngestion]
+		service.Audience = audience
+		config.Services[azlogs.ServiceNameIngestion] = service
+	}
+	return config, nil
+}
+
+// tokenScope returns the scope of the tokens that the logs client requests in the cloud.
+func tokenScope(config cloud.Configuration) string {
+	return strings.TrimSuffix(config.Services[azlogs.ServiceNameIngestion].Audience, "/") + "/.default"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingCredential records the scopes of the requested tokens.
+type recordingCredential struct {
+	mutex  sync.Mutex
+	scopes []string
+}
+
+func (c *recordingCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.scopes = append(c.scopes, options.Scopes...)
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+type statusTransport int
+
+func (s statusTransport) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: int(s), Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+}
+
+func TestParseCloud_selectsSovereignCloud(t *testing.T) {
+	tests := map[string]string{
+		"":                  "https://monitor.azure.com/.default",
+		"AzurePublic":       "https://monitor.azure.com/.default",
+		"AzureGovernment":   "https://monitor.azure.us/.default",
+		"AzureUSGovernment": "https://monitor.azure.us/.default",
+		"azurechina":        "https://monitor.azure.cn/.default",
+	}
+	for name, scope := range tests {
+		config, err := parseCloud(name, "", "")
+
+		assert.NoError(t, err, name)
+		assert.Equal(t, scope, tokenScope(config), name)
+	}
+
+	_, err := parseCloud("AzureGermany", "", "")
+	assert.Error(t, err)
+}
+
+func TestParseCloud_overrides_doNotChangeSdkDefaults(t *testing.T) {
+	config, err := parseCloud("AzurePublic", "https://login.example.com/", "https://monitor.example.com")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://login.example.com/", config.ActiveDirectoryAuthorityHost)
+	assert.Equal(t, "https://monitor.example.com/.default", tokenScope(config))
+	assert.Equal(t, "https://login.microsoftonline.com/", cloud.AzurePublic.ActiveDirectoryAuthorityHost)
+	assert.Equal(t, "https://monitor.azure.com/.default", tokenScope(cloud.AzurePublic))
+}
+
+func TestConstructClient_cloud_requestsTokenForCloudAudience(t *testing.T) {
+	config, err := parseCloud("AzureGovernment", "", "")
+	assert.NoError(t, err)
+	cred := &recordingCredential{}
+	client, err := constructClient("https://dummy.ingest.monitor.azure.us", cred, azcore.ClientOptions{Cloud: config, Transport: statusTransport(http.StatusNoContent)})
+	assert.NoError(t, err)
+
+	_, err = client.Upload(context.Background(), "dcr-1", "Custom-logs", []byte(`[]`), nil)
+
+	assert.NoError(t, err)
+	assert.Len(t, cred.scopes, 1)
+	assert.Contains(t, cred.scopes[0], "https://monitor.azure.us/")
+}
@@ -0,0 +1,64 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	compressionGzip = "gzip"
+	compressionNone = "none"
+)
+
+var gzipWriterPool = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// parseCompression returns whether requests are gzip compressed. Requests are not compressed by default.
+func parseCompression(value string) (bool, error) {
+	switch value {
+	case compressionGzip:
+		return true, nil
+	case "", compressionNone:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown compression %q, expected %s or %s", value, compressionGzip, compressionNone)
+	}
+}
+
+// gzipPayload compresses a payload right before it is sent.
+// Azure limits the uncompressed JSON of a request to 1 MB as well, so batches are cut on their uncompressed size and
+// compression only reduces the bytes on the wire, not the number of requests.
+func gzipPayload(payload []byte) ([]byte, error) {
+	var out bytes.Buffer
+	zw := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(zw)
+	zw.Reset(&out)
+	if _, err := zw.Write(payload); err != nil {
+		return nil, errors.Wrap(err, "failed to compress payload")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress payload")
+	}
+	return out.Bytes(), nil
+}
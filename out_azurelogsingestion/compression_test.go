@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func gunzip(t *testing.T, body []byte) []byte {
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	assert.NoError(t, err)
+	decompressed, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	return decompressed
+}
+
+func TestParseCompression_defaultsToNone(t *testing.T) {
+	compress, err := parseCompression("")
+	assert.NoError(t, err)
+	assert.False(t, compress)
+
+	compress, err = parseCompression("gzip")
+	assert.NoError(t, err)
+	assert.True(t, compress)
+
+	_, err = parseCompression("zstd")
+	assert.Error(t, err)
+}
+
+func TestBatchWriter_compressibleRows_staysBelowUncompressedLimit(t *testing.T) {
+	var writer batchWriter
+	for idx := range 50000 {
+		writer.writeRow([]byte(fmt.Sprintf(`{"log":"request %d handled in 12ms","stream":"stdout","kubernetes_namespace_name":"default"}`, idx)))
+	}
+	payloads := writer.finish()
+
+	assert.Greater(t, len(payloads), 1)
+	for _, payload := range payloads {
+		assert.LessOrEqual(t, len(payload), oneMb)
+	}
+	assert.Len(t, reverseEntries(t, payloads), 50000)
+}
+
+func TestGzipPayload_roundTrips(t *testing.T) {
+	payload := []byte(`[{"log":"request handled in 12ms"}]`)
+
+	compressed, err := gzipPayload(payload)
+
+	assert.NoError(t, err)
+	assert.Equal(t, payload, gunzip(t, compressed))
+}
+
+func TestUpload_compression_sendsGzippedBody(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	operator := &AzureOperator{logsClient: mockClient, compress: true}
+	payload := []byte(`[{"log":"replayed from the spool"}]`)
+
+	mockClient.EXPECT().Upload(gomock.Any(), "dcr-1", "Custom-logs", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ any, _ string, _ string, body []byte, options *azlogs.UploadOptions) (azlogs.UploadResponse, error) {
+			assert.Equal(t, compressionGzip, *options.ContentEncoding)
+			assert.Equal(t, payload, gunzip(t, body))
+			return azlogs.UploadResponse{}, nil
+		})
+
+	err := operator.upload(Batch{Destination: Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-logs"}, Payload: payload})
+
+	assert.NoError(t, err)
+}
@@ -0,0 +1,114 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	modeMapping     = "mapping"
+	modePassthrough = "passthrough"
+)
+
+// RecordConverter turns a decoded fluent-bit record into the row that is sent to Azure.
+type RecordConverter interface {
+	Convert(record map[interface{}]interface{}, timestamp time.Time) FluentbitLogEntry
+	// Encode writes the row of the record in fields as JSON to buf, without building the intermediate entry.
+	Encode(buf *bytes.Buffer, fields *recordFields, timestamp time.Time)
+}
+
+// Convert applies the column mapping to the record.
+func (m ColumnMapping) Convert(record map[interface{}]interface{}, timestamp time.Time) FluentbitLogEntry {
+	return convertToFluentbitLogEntry(record, timestamp, m)
+}
+
+// passthroughConverter forwards the complete record and only adds TimeGenerated.
+type passthroughConverter struct{}
+
+func (passthroughConverter) Convert(record map[interface{}]interface{}, timestamp time.Time) FluentbitLogEntry {
+	entry := FluentbitLogEntry{}
+	for k, v := range record {
+		entry[convertKey(k)] = convertRecordValue(v)
+	}
+	entry[timeGeneratedColumn] = timestamp.UTC().Format(time.RFC3339Nano)
+	return entry
+}
+
+func newRecordConverter(mode string, mapping string, mappingFile string) (RecordConverter, error) {
+	switch mode {
+	case "", modeMapping:
+		return loadColumnMapping(mapping, mappingFile)
+	case modePassthrough:
+		if mapping != "" || mappingFile != "" {
+			return nil, errors.New("Mapping and MappingFile cannot be used in passthrough mode")
+		}
+		return passthroughConverter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mode %q, expected %s or %s", mode, modeMapping, modePassthrough)
+	}
+}
+
+// convertRecordValue recursively converts msgpack values to values that encoding/json can marshal.
+func convertRecordValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, nested := range value {
+			converted[convertKey(k)] = convertRecordValue(nested)
+		}
+		return converted
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, nested := range value {
+			converted[k] = convertRecordValue(nested)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, nested := range value {
+			converted[i] = convertRecordValue(nested)
+		}
+		return converted
+	case []byte:
+		return string(value)
+	case output.FLBTime:
+		return value.UTC().Format(time.RFC3339Nano)
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	case nil, string, bool, float32, float64, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return value
+	default:
+		log.Debug().Msgf("[azurelogsingestion] Converting unsupported value of type %T to string", v)
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+func convertKey(k interface{}) string {
+	switch key := k.(type) {
+	case string:
+		return key
+	case []byte:
+		return string(key)
+	default:
+		return fmt.Sprintf("%v", key)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRecordConverter_defaultMode_returnsDefaultMapping(t *testing.T) {
+	converter, err := newRecordConverter("", "", "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultColumnMapping, converter)
+}
+
+func TestNewRecordConverter_passthroughWithMapping_returnsError(t *testing.T) {
+	_, err := newRecordConverter(modePassthrough, "log=log", "")
+
+	assert.Error(t, err)
+}
+
+func TestNewRecordConverter_unknownMode_returnsError(t *testing.T) {
+	_, err := newRecordConverter("unknown", "", "")
+
+	assert.Error(t, err)
+}
+
+func TestPassthroughConverter_convertsRecordRecursively(t *testing.T) {
+	now := time.Now().UTC()
+	record := map[interface{}]interface{}{
+		"log":     []byte("message"),
+		"level":   int64(3),
+		"success": true,
+		"time":    output.FLBTime{Time: now},
+		"kubernetes": map[interface{}]interface{}{
+			"labels": map[interface{}]interface{}{
+				"app": []byte("api"),
+			},
+			"ports": []interface{}{uint64(80), []byte("http")},
+		},
+	}
+
+	entry := passthroughConverter{}.Convert(record, now)
+	jsonValue, err := json.Marshal(entry)
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"TimeGenerated": "`+now.Format(time.RFC3339Nano)+`",
+		"log": "message",
+		"level": 3,
+		"success": true,
+		"time": "`+now.Format(time.RFC3339Nano)+`",
+		"kubernetes": {"labels": {"app": "api"}, "ports": [80, "http"]}
+	}`, string(jsonValue))
+}
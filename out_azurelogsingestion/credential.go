@@ -0,0 +1,146 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const authenticationTimeout = 30 * time.Second
+
+// credentialProvider creates the credential of an operator lazily and verifies it in the background,
+// so an unavailable Azure AD does not prevent fluent-bit from starting. Until the first token is acquired
+// the operator is degraded and its flushes are retried.
+type credentialProvider struct {
+	create  func() (azcore.TokenCredential, error)
+	scope   string
+	backoff func(attempt int) time.Duration
+	// requested is called with the result of every token request, when it is set.
+	requested func(error)
+	logger    zerolog.Logger
+	mutex     sync.Mutex
+	cred      azcore.TokenCredential
+	ready     atomic.Bool
+	expiresOn atomic.Int64
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func newCredentialProvider(create func() (azcore.TokenCredential, error), scope string) *credentialProvider {
+	return &credentialProvider{create: create, scope: scope, backoff: retryBackoff, logger: log.Logger}
+}
+
+// credential returns the credential, creating it when an earlier attempt failed.
+func (p *credentialProvider) credential() (azcore.TokenCredential, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.cred != nil {
+		return p.cred, nil
+	}
+	cred, err := p.create()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create credential")
+	}
+	p.cred = cred
+	return cred, nil
+}
+
+// GetToken implements azcore.TokenCredential, so clients can be created before the credential is.
+func (p *credentialProvider) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	token, err := p.getToken(ctx, options)
+	if err == nil {
+		p.expiresOn.Store(token.ExpiresOn.UnixNano())
+	}
+	if p.requested != nil {
+		p.requested(err)
+	}
+	return token, err
+}
+
+func (p *credentialProvider) getToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	cred, err := p.credential()
+	if err != nil {
+		return azcore.AccessToken{}, err
+	}
+	return cred.GetToken(ctx, options)
+}
+
+func (p *credentialProvider) authenticate(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, authenticationTimeout)
+	defer cancel()
+	if _, err := p.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{p.scope}}); err != nil {
+		return err
+	}
+	p.ready.Store(true)
+	return nil
+}
+
+// authenticated reports whether a token was acquired. A nil provider is always authenticated.
+func (p *credentialProvider) authenticated() bool {
+	return p == nil || p.ready.Load()
+}
+
+// tokenExpiresOn returns the expiry of the last token that was acquired, or the zero time when there is none.
+func (p *credentialProvider) tokenExpiresOn() time.Time {
+	if p == nil {
+		return time.Time{}
+	}
+	expiresOn := p.expiresOn.Load()
+	if expiresOn == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, expiresOn).UTC()
+}
+
+// start acquires the first token in the background, retrying with a backoff until it succeeds or the provider is closed.
+func (p *credentialProvider) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		for attempt := 0; ; attempt++ {
+			err := p.authenticate(ctx)
+			if err == nil {
+				p.logger.Debug().Msg("[azurelogsingestion] Successfully retrieved token for client")
+				return
+			}
+			backoff := p.backoff(attempt)
+			p.logger.Err(err).Msgf("[azurelogsingestion] Failed to authenticate with Azure, retrying in %s. Flushes are retried until authentication succeeds", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+		}
+	}()
+}
+
+func (p *credentialProvider) close() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+// fakeCredential fails the given number of token requests before it returns a token.
+type fakeCredential struct {
+	failures int32
+	calls    atomic.Int32
+	// expired makes the credential return tokens that already expired.
+	expired bool
+}
+
+func (c *fakeCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if c.calls.Add(1) <= c.failures {
+		return azcore.AccessToken{}, errors.New("AADSTS90002: tenant not found")
+	}
+	if c.expired {
+		return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(-time.Minute)}, nil
+	}
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func noBackoff(int) time.Duration {
+	return time.Millisecond
+}
+
+func TestCredentialProvider_start_retriesUntilAuthenticated(t *testing.T) {
+	cred := &fakeCredential{failures: 2}
+	creates := 0
+	provider := newCredentialProvider(func() (azcore.TokenCredential, error) {
+		creates++
+		if creates == 1 {
+			return nil, errors.New("no credential available")
+		}
+		return cred, nil
+	}, tokenScope(cloud.AzurePublic))
+	provider.backoff = noBackoff
+
+	assert.False(t, provider.authenticated())
+	provider.start()
+
+	assert.Eventually(t, provider.authenticated, time.Second, time.Millisecond)
+	provider.close()
+	assert.Equal(t, 2, creates)
+	assert.Equal(t, int32(3), cred.calls.Load())
+}
+
+func TestCredentialProvider_close_stopsRetrying(t *testing.T) {
+	provider := newCredentialProvider(func() (azcore.TokenCredential, error) {
+		return &fakeCredential{failures: 1000}, nil
+	}, tokenScope(cloud.AzurePublic))
+	provider.backoff = func(int) time.Duration { return time.Hour }
+	provider.start()
+
+	provider.close()
+
+	assert.False(t, provider.authenticated())
+}
+
+func TestCredentialProvider_nil_isAuthenticated(t *testing.T) {
+	var provider *credentialProvider
+
+	assert.True(t, provider.authenticated())
+}
+
+func TestFlushInstance_notAuthenticated_retriesFlush(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	operator := newTestOperator(mockClient, "Custom-logs")
+	operator.credentials = newCredentialProvider(func() (azcore.TokenCredential, error) {
+		return &fakeCredential{}, nil
+	}, tokenScope(cloud.AzurePublic))
+	id := azureLogOperators.register(operator)
+	defer exitInstance(id)
+
+	assert.Equal(t, output.FLB_RETRY, flushChunk(id, encodeChunk(t, "degraded")))
+}
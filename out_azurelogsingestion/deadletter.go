@@ -0,0 +1,174 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	deadLetterFilePrefix         = "deadletter-"
+	deadLetterFileSuffix         = ".ndjson"
+	defaultDeadLetterMaxFileSize = 10 << 20
+	defaultDeadLetterRetention   = 7 * 24 * time.Hour
+)
+
+// deadLetterEntry is written as a single line for every batch that Azure rejected.
+type deadLetterEntry struct {
+	Timestamp      string          `json:"timestamp"`
+	Tag            string          `json:"tag,omitempty"`
+	Endpoint       string          `json:"endpoint,omitempty"`
+	DcrImmutableId string          `json:"dcr_immutable_id"`
+	StreamName     string          `json:"stream_name"`
+	StatusCode     int             `json:"status_code,omitempty"`
+	ErrorCode      string          `json:"error_code,omitempty"`
+	RequestId      string          `json:"request_id,omitempty"`
+	Error          string          `json:"error"`
+	Records        json.RawMessage `json:"records"`
+}
+
+// deadLetterSink writes rejected batches to NDJSON files, rotating them by size and removing them after the retention period.
+type deadLetterSink struct {
+	dir         string
+	maxFileSize int64
+	retention   time.Duration
+	mutex       sync.Mutex
+	file        *os.File
+	fileSize    int64
+	logger      zerolog.Logger
+}
+
+func newDeadLetterSink(dir string, maxFileSize int, retention time.Duration) (*deadLetterSink, error) {
+	if maxFileSize <= 0 {
+		maxFileSize = defaultDeadLetterMaxFileSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create dead-letter directory %s", dir)
+	}
+	sink := &deadLetterSink{dir: dir, maxFileSize: int64(maxFileSize), retention: retention, logger: log.Logger}
+	sink.removeExpired(time.Now())
+	return sink, nil
+}
+
+func newDeadLetterEntry(batch Batch, uploadErr error, now time.Time) deadLetterEntry {
+	entry := deadLetterEntry{
+		Timestamp:      now.UTC().Format(time.RFC3339Nano),
+		Tag:            batch.Tag,
+		Endpoint:       batch.Destination.Endpoint,
+		DcrImmutableId: batch.Destination.DcrImmutableId,
+		StreamName:     batch.Destination.StreamName,
+		Error:          uploadErr.Error(),
+		Records:        batch.Payload,
+	}
+	var responseErr *azcore.ResponseError
+	if errors.As(uploadErr, &responseErr) {
+		entry.StatusCode = responseErr.StatusCode
+		entry.ErrorCode = responseErr.ErrorCode
+		if responseErr.RawResponse != nil {
+			entry.RequestId = responseErr.RawResponse.Header.Get("x-ms-request-id")
+		}
+	}
+	if !json.Valid(entry.Records) {
+		encoded, _ := json.Marshal(string(batch.Payload))
+		entry.Records = encoded
+	}
+	return entry
+}
+
+// write appends the rejected batch to the current dead-letter file.
+func (d *deadLetterSink) write(batch Batch, uploadErr error) error {
+	now := time.Now()
+	line, err := json.Marshal(newDeadLetterEntry(batch, uploadErr, now))
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal dead-letter entry")
+	}
+	line = append(line, '\n')
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.file == nil || d.fileSize+int64(len(line)) > d.maxFileSize {
+		if err := d.rotate(now); err != nil {
+			return err
+		}
+	}
+	written, err := d.file.Write(line)
+	d.fileSize += int64(written)
+	return errors.Wrap(err, "failed to write dead-letter entry")
+}
+
+// close closes the current dead-letter file. A later write opens a new one.
+func (d *deadLetterSink) close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return errors.Wrap(err, "failed to close dead-letter file")
+}
+
+func (d *deadLetterSink) rotate(now time.Time) error {
+	if d.file != nil {
+		if err := d.file.Close(); err != nil {
+			d.logger.Err(err).Msg("[azurelogsingestion] Failed to close dead-letter file")
+		}
+		d.file = nil
+	}
+	d.removeExpired(now)
+	name := fmt.Sprintf("%s%s%s", deadLetterFilePrefix, now.UTC().Format("20060102T150405.000000000"), deadLetterFileSuffix)
+	file, err := os.OpenFile(filepath.Join(d.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open dead-letter file")
+	}
+	d.file = file
+	d.fileSize = 0
+	return nil
+}
+
+// removeExpired deletes dead-letter files that were last written before the retention period.
+func (d *deadLetterSink) removeExpired(now time.Time) {
+	if d.retention <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		d.logger.Err(err).Msg("[azurelogsingestion] Failed to list dead-letter directory")
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), deadLetterFilePrefix) || !strings.HasSuffix(entry.Name(), deadLetterFileSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < d.retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(d.dir, entry.Name())); err != nil {
+			d.logger.Err(err).Msgf("[azurelogsingestion] Failed to remove expired dead-letter file %s", entry.Name())
+		}
+	}
+}
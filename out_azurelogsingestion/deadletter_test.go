@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func readDeadLetterEntries(t *testing.T, dir string) []deadLetterEntry {
+	files, err := filepath.Glob(filepath.Join(dir, deadLetterFilePrefix+"*"+deadLetterFileSuffix))
+	assert.NoError(t, err)
+	var entries []deadLetterEntry
+	for _, file := range files {
+		f, err := os.Open(file)
+		assert.NoError(t, err)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry deadLetterEntry
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+			entries = append(entries, entry)
+		}
+		assert.NoError(t, f.Close())
+	}
+	return entries
+}
+
+func TestDeadLetterSink_write_storesBatchWithResponseDetails(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := newDeadLetterSink(dir, 0, time.Hour)
+	assert.NoError(t, err)
+	uploadErr := &azcore.ResponseError{
+		StatusCode:  400,
+		ErrorCode:   "InvalidStream",
+		RawResponse: &http.Response{StatusCode: 400, Header: http.Header{"X-Ms-Request-Id": {"request-1"}}},
+	}
+
+	err = sink.write(Batch{Destination: spoolDestination, Tag: "kube.app", Payload: []byte(`[{"log":"message"}]`)}, uploadErr)
+
+	assert.NoError(t, err)
+	entries := readDeadLetterEntries(t, dir)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "kube.app", entries[0].Tag)
+	assert.Equal(t, "dcr-1", entries[0].DcrImmutableId)
+	assert.Equal(t, "Custom-stream", entries[0].StreamName)
+	assert.Equal(t, 400, entries[0].StatusCode)
+	assert.Equal(t, "InvalidStream", entries[0].ErrorCode)
+	assert.Equal(t, "request-1", entries[0].RequestId)
+	assert.JSONEq(t, `[{"log":"message"}]`, string(entries[0].Records))
+}
+
+func TestDeadLetterSink_write_rotatesFiles(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := newDeadLetterSink(dir, 300, time.Hour)
+	assert.NoError(t, err)
+
+	for range 3 {
+		assert.NoError(t, sink.write(Batch{Destination: spoolDestination, Payload: []byte(`[{"log":"message"}]`)}, responseError(400, nil)))
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+deadLetterFileSuffix))
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+	assert.Len(t, readDeadLetterEntries(t, dir), 3)
+}
+
+func TestNewDeadLetterSink_removesExpiredFiles(t *testing.T) {
+	dir := t.TempDir()
+	expired := filepath.Join(dir, deadLetterFilePrefix+"old"+deadLetterFileSuffix)
+	recent := filepath.Join(dir, deadLetterFilePrefix+"new"+deadLetterFileSuffix)
+	assert.NoError(t, os.WriteFile(expired, []byte("{}\n"), 0600))
+	assert.NoError(t, os.WriteFile(recent, []byte("{}\n"), 0600))
+	assert.NoError(t, os.Chtimes(expired, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)))
+
+	_, err := newDeadLetterSink(dir, 0, time.Hour)
+
+	assert.NoError(t, err)
+	assert.NoFileExists(t, expired)
+	assert.FileExists(t, recent)
+}
+
+func TestUpload_permanentErrorWithDeadLetter_writesBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	dir := t.TempDir()
+	sink, err := newDeadLetterSink(dir, 0, time.Hour)
+	assert.NoError(t, err)
+	policy, _ := parseRetryPolicy("", true)
+	operator := &AzureOperator{config: AzureConfig{Endpoint: spoolDestination.Endpoint}, logsClient: mockClient, retryPolicy: policy, deadLetter: sink}
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(400, nil))
+
+	assert.NoError(t, operator.upload(Batch{Destination: spoolDestination, Tag: "kube.app", Payload: []byte(`[]`)}))
+	entries := readDeadLetterEntries(t, dir)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, 400, entries[0].StatusCode)
+}
@@ -0,0 +1,143 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTrackedChunks   = 1024
+	defaultTrackedChunkTTL = time.Hour
+)
+
+// chunkID identifies a fluent-bit chunk, which is delivered with the same content and tag when it is retried.
+type chunkID [sha256.Size]byte
+
+func newChunkID(tag string, data []byte) chunkID {
+	hash := sha256.New()
+	hash.Write([]byte(tag))
+	hash.Write([]byte{0})
+	hash.Write(data)
+	var id chunkID
+	copy(id[:], hash.Sum(nil))
+	return id
+}
+
+type batchID [sha256.Size]byte
+
+func newBatchID(batch Batch) batchID {
+	hash := sha256.New()
+	for _, part := range []string{batch.Destination.Endpoint, batch.Destination.DcrImmutableId, batch.Destination.StreamName} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(batch.Payload)
+	var id batchID
+	copy(id[:], hash.Sum(nil))
+	return id
+}
+
+type chunkDeliveries struct {
+	delivered map[batchID]bool
+	attempts  int
+	updated   time.Time
+}
+
+// deliveryTracker remembers which batches of a partially delivered chunk were accepted by Azure,
+// so they are not uploaded again when fluent-bit retries the chunk.
+type deliveryTracker struct {
+	mutex     sync.Mutex
+	chunks    map[chunkID]*chunkDeliveries
+	maxChunks int
+	ttl       time.Duration
+}
+
+func newDeliveryTracker(maxChunks int, ttl time.Duration) *deliveryTracker {
+	return &deliveryTracker{chunks: map[chunkID]*chunkDeliveries{}, maxChunks: maxChunks, ttl: ttl}
+}
+
+// pending returns the batches of the chunk that were not delivered yet.
+func (t *deliveryTracker) pending(chunk chunkID, batches []Batch) []Batch {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	deliveries, ok := t.chunks[chunk]
+	if !ok || time.Since(deliveries.updated) > t.ttl {
+		return batches
+	}
+	var remaining []Batch
+	for _, batch := range batches {
+		if !deliveries.delivered[newBatchID(batch)] {
+			remaining = append(remaining, batch)
+		}
+	}
+	return remaining
+}
+
+// attempt counts an attempt to deliver the chunk and returns the number of earlier attempts.
+func (t *deliveryTracker) attempt(chunk chunkID) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	deliveries, ok := t.chunks[chunk]
+	if !ok || time.Since(deliveries.updated) > t.ttl {
+		t.evict()
+		deliveries = &chunkDeliveries{delivered: map[batchID]bool{}}
+		t.chunks[chunk] = deliveries
+	}
+	attempts := deliveries.attempts
+	deliveries.attempts++
+	deliveries.updated = time.Now()
+	return attempts
+}
+
+func (t *deliveryTracker) markDelivered(chunk chunkID, batch Batch) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	deliveries, ok := t.chunks[chunk]
+	if !ok {
+		t.evict()
+		deliveries = &chunkDeliveries{delivered: map[batchID]bool{}}
+		t.chunks[chunk] = deliveries
+	}
+	deliveries.delivered[newBatchID(batch)] = true
+	deliveries.updated = time.Now()
+}
+
+// complete forgets the chunk once all its batches are delivered.
+func (t *deliveryTracker) complete(chunk chunkID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.chunks, chunk)
+}
+
+// evict removes expired chunks and, when the tracker is still full, the least recently updated chunk.
+func (t *deliveryTracker) evict() {
+	var oldest chunkID
+	var oldestUpdated time.Time
+	for id, deliveries := range t.chunks {
+		if time.Since(deliveries.updated) > t.ttl {
+			delete(t.chunks, id)
+			continue
+		}
+		if oldestUpdated.IsZero() || deliveries.updated.Before(oldestUpdated) {
+			oldest, oldestUpdated = id, deliveries.updated
+		}
+	}
+	if len(t.chunks) >= t.maxChunks {
+		delete(t.chunks, oldest)
+	}
+}
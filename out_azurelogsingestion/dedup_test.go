@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestNewChunkID_dependsOnTagAndData(t *testing.T) {
+	assert.Equal(t, newChunkID("kube.app", []byte("data")), newChunkID("kube.app", []byte("data")))
+	assert.NotEqual(t, newChunkID("kube.app", []byte("data")), newChunkID("kube.other", []byte("data")))
+	assert.NotEqual(t, newChunkID("kube.app", []byte("data")), newChunkID("kube.app", []byte("other")))
+}
+
+func TestDeliveryTracker_pending_skipsDeliveredBatches(t *testing.T) {
+	tracker := newDeliveryTracker(10, time.Hour)
+	chunk := newChunkID("kube.app", []byte("data"))
+	first := Batch{Destination: spoolDestination, Payload: []byte("1")}
+	second := Batch{Destination: spoolDestination, Payload: []byte("2")}
+
+	tracker.markDelivered(chunk, first)
+
+	assert.Equal(t, []Batch{second}, tracker.pending(chunk, []Batch{first, second}))
+	assert.Equal(t, []Batch{first, second}, tracker.pending(newChunkID("kube.app", []byte("other")), []Batch{first, second}))
+
+	tracker.complete(chunk)
+
+	assert.Equal(t, []Batch{first, second}, tracker.pending(chunk, []Batch{first, second}))
+}
+
+func TestDeliveryTracker_attempt_countsAttemptsPerChunk(t *testing.T) {
+	tracker := newDeliveryTracker(10, time.Hour)
+	chunk := newChunkID("kube.app", []byte("data"))
+
+	assert.Equal(t, 0, tracker.attempt(chunk))
+	assert.Equal(t, 1, tracker.attempt(chunk))
+	assert.Equal(t, 0, tracker.attempt(newChunkID("kube.other", []byte("data"))))
+
+	tracker.complete(chunk)
+
+	assert.Equal(t, 0, tracker.attempt(chunk))
+}
+
+func TestDeliveryTracker_markDelivered_evictsOldestChunk(t *testing.T) {
+	tracker := newDeliveryTracker(2, time.Hour)
+	batch := Batch{Payload: []byte("1")}
+	chunks := []chunkID{newChunkID("a", nil), newChunkID("b", nil), newChunkID("c", nil)}
+
+	for _, chunk := range chunks {
+		tracker.markDelivered(chunk, batch)
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Len(t, tracker.chunks, 2)
+	assert.NotContains(t, tracker.chunks, chunks[0])
+}
+
+func TestProcessEntries_retriedChunk_onlySendsRemainingBatches(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	operator := &AzureOperator{
+		config:     AzureConfig{Endpoint: spoolDestination.Endpoint},
+		logsClient: mockClient,
+		uploads:    newUploadPool(1),
+		deliveries: newDeliveryTracker(10, time.Hour),
+	}
+	chunk := newChunkID("kube.app", []byte("data"))
+	batches := []Batch{
+		{Destination: spoolDestination, Payload: []byte(`[{"log":"1"}]`)},
+		{Destination: spoolDestination, Payload: []byte(`[{"log":"2"}]`)},
+	}
+
+	gomock.InOrder(
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), []byte(`[{"log":"1"}]`), gomock.Any()).Return(azlogs.UploadResponse{}, nil),
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), []byte(`[{"log":"2"}]`), gomock.Any()).Return(azlogs.UploadResponse{}, errors.New("azure unavailable")),
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), []byte(`[{"log":"2"}]`), gomock.Any()).Return(azlogs.UploadResponse{}, nil),
+	)
+
+	assert.Error(t, processEntries(chunk, batches, operator))
+	assert.NoError(t, processEntries(chunk, batches, operator))
+	assert.Empty(t, operator.deliveries.chunks)
+}
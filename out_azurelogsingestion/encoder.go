@@ -0,0 +1,432 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxPooledBufferSize is the largest buffer that is returned to batchBufferPool.
+const maxPooledBufferSize = 2 * oneMb
+
+// batchBufferPool holds the buffers that batches are written to. They are returned by releaseBatches once the batches are sent.
+var batchBufferPool = sync.Pool{
+	New: func() any {
+		return bytes.NewBuffer(make([]byte, 0, oneMb))
+	},
+}
+
+// releaseBatches returns the payload buffers to the pool. The batches must not be used afterwards.
+func releaseBatches(batches []Batch) {
+	for _, batch := range batches {
+		releaseBuffer(batch.Payload)
+	}
+}
+
+// releaseBuffer only keeps buffers of about the size of a request, so a buffer that grew for a large payload,
+// such as a batch that was split after Azure rejected it, does not stay in memory.
+func releaseBuffer(buf []byte) {
+	if cap(buf) >= oneMb && cap(buf) <= maxPooledBufferSize {
+		batchBufferPool.Put(bytes.NewBuffer(buf[:0]))
+	}
+}
+
+// batchWriter appends JSON rows to an array and starts a new array when the next row would exceed the request size.
+// Azure limits the uncompressed body to 1 MB, also when the request is compressed.
+type batchWriter struct {
+	buf      *bytes.Buffer
+	payloads [][]byte
+	rows     int
+	records  []int
+}
+
+func (w *batchWriter) writeRow(row []byte) {
+	if w.buf != nil && !w.fits(row) {
+		w.cut()
+	}
+	if w.buf == nil {
+		w.buf = batchBufferPool.Get().(*bytes.Buffer)
+		w.buf.Reset()
+		w.buf.Write(startBytes)
+	} else {
+		w.buf.Write(seperatorBytes)
+	}
+	w.buf.Write(row)
+	w.rows++
+}
+
+func (w *batchWriter) fits(row []byte) bool {
+	return w.buf.Len()+len(row)+len(endBytes)+extraBufferHundredBytes <= oneMb
+}
+
+// cut closes the current array. A payload that fills most of the buffer takes the buffer over, so no copy is needed.
+// A smaller payload is copied and the buffer is returned to the pool, as a batch can wait in the queue for a long time
+// and the queue only counts the size of its payload.
+func (w *batchWriter) cut() {
+	w.buf.Write(endBytes)
+	payload := w.buf.Bytes()
+	if len(payload) < cap(payload)/2 {
+		payload = bytes.Clone(payload)
+		releaseBuffer(w.buf.Bytes())
+	}
+	w.payloads = append(w.payloads, payload)
+	w.records = append(w.records, w.rows)
+	w.buf = nil
+	w.rows = 0
+}
+
+func (w *batchWriter) finish() [][]byte {
+	if w.buf != nil {
+		w.cut()
+	}
+	return w.payloads
+}
+
+// splitBatch splits the JSON array of a batch in two halves. It returns no batches when the batch holds a single row.
+func splitBatch(batch Batch) ([]Batch, error) {
+	var rows []json.RawMessage
+	if err := json.Unmarshal(batch.Payload, &rows); err != nil {
+		return nil, errors.Wrap(err, "failed to split batch")
+	}
+	if len(rows) < 2 {
+		return nil, nil
+	}
+	half := len(rows) / 2
+	halves := make([]Batch, 0, 2)
+	for _, part := range [][]json.RawMessage{rows[:half], rows[half:]} {
+		var writer batchWriter
+		for _, row := range part {
+			writer.writeRow(row)
+		}
+		for idx, payload := range writer.finish() {
+			halves = append(halves, Batch{Destination: batch.Destination, Tag: batch.Tag, Payload: payload, Records: writer.records[idx], Trace: batch.Trace})
+		}
+	}
+	return halves, nil
+}
+
+// batchBuilder encodes the records of a flush straight into per-destination batches.
+type batchBuilder struct {
+	config       AzureConfig
+	converter    RecordConverter
+	oversized    oversizedRecords
+	metrics      *instanceMetrics
+	logger       zerolog.Logger
+	tag          string
+	chunk        chunkID
+	index        int
+	fields       recordFields
+	record       bytes.Buffer
+	destinations []Destination
+	writers      map[Destination]*batchWriter
+	converted    map[Destination]int
+	oversizedOut map[Destination]int
+	dropped      int
+}
+
+func newBatchBuilder(operator *AzureOperator, tag string) *batchBuilder {
+	return &batchBuilder{
+		config:       operator.config,
+		converter:    operator.converter,
+		oversized:    operator.oversized,
+		metrics:      operator.metrics,
+		logger:       operator.logger,
+		tag:          tag,
+		writers:      map[Destination]*batchWriter{},
+		converted:    map[Destination]int{},
+		oversizedOut: map[Destination]int{},
+	}
+}
+
+func (b *batchBuilder) add(record map[interface{}]interface{}, timestamp time.Time) {
+	index := b.index
+	b.index++
+	b.fields.reset(record)
+	destination, ok := b.config.resolveRecordDestination(&b.fields, b.tag)
+	if !ok {
+		b.dropped++
+		return
+	}
+	writer, ok := b.writers[destination]
+	if !ok {
+		writer = &batchWriter{}
+		b.writers[destination] = writer
+		b.destinations = append(b.destinations, destination)
+	}
+	b.record.Reset()
+	b.converter.Encode(&b.record, &b.fields, timestamp)
+	b.converted[destination]++
+	if b.record.Len() <= maxRecordSize {
+		writer.writeRow(b.record.Bytes())
+		return
+	}
+	// Oversized records are rare, so they are handled on the slower path that works on the converted entry.
+	rows := b.oversized.fit(b.converter.Convert(record, timestamp), b.record.Bytes(), newPartId(b.chunk, index), destination, b.tag)
+	if len(rows) == 0 {
+		b.oversizedOut[destination]++
+	}
+	for _, row := range rows {
+		writer.writeRow(row)
+	}
+}
+
+func (b *batchBuilder) batches() []Batch {
+	if b.dropped > 0 {
+		b.logger.Warn().Msgf("[azurelogsingestion] No route configured for %d records with tag %s, dropping them", b.dropped, b.tag)
+		b.metrics.recordsDropped(Destination{}, dropReasonNoRoute, b.dropped)
+	}
+	var batches []Batch
+	for _, destination := range b.destinations {
+		b.metrics.recordsConverted(destination, b.converted[destination])
+		b.metrics.recordsDropped(destination, dropReasonOversized, b.oversizedOut[destination])
+		writer := b.writers[destination]
+		for idx, payload := range writer.finish() {
+			batches = append(batches, Batch{Destination: destination, Tag: b.tag, Payload: payload, Records: writer.records[idx]})
+		}
+	}
+	return batches
+}
+
+// Encode writes the mapped columns of the record as a JSON object.
+func (m ColumnMapping) Encode(buf *bytes.Buffer, fields *recordFields, timestamp time.Time) {
+	writeTimeGenerated(buf, timestamp)
+	for _, column := range m {
+		value, ok := fields.lookup(column.Path)
+		if !ok {
+			if !column.Required {
+				continue
+			}
+			value = ""
+		}
+		buf.WriteByte(',')
+		writeJsonString(buf, column.Name)
+		buf.WriteByte(':')
+		writeJsonValue(buf, value)
+	}
+	buf.WriteByte('}')
+}
+
+// Encode writes the complete record as a JSON object. Keys are sorted so a retried chunk is encoded identically.
+func (passthroughConverter) Encode(buf *bytes.Buffer, fields *recordFields, timestamp time.Time) {
+	record := fields.record
+	writeTimeGenerated(buf, timestamp)
+	for _, key := range sortedKeys(record) {
+		if key.name == timeGeneratedColumn {
+			continue
+		}
+		buf.WriteByte(',')
+		writeJsonString(buf, key.name)
+		buf.WriteByte(':')
+		writeJsonValue(buf, record[key.original])
+	}
+	buf.WriteByte('}')
+}
+
+func writeTimeGenerated(buf *bytes.Buffer, timestamp time.Time) {
+	buf.WriteString(`{"` + timeGeneratedColumn + `":"`)
+	buf.Write(timestamp.UTC().AppendFormat(buf.AvailableBuffer(), time.RFC3339Nano))
+	buf.WriteByte('"')
+}
+
+type recordKey struct {
+	name     string
+	original interface{}
+}
+
+func sortedKeys(m map[interface{}]interface{}) []recordKey {
+	keys := make([]recordKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, recordKey{name: convertKey(k), original: k})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].name < keys[j].name })
+	return keys
+}
+
+// writeJsonValue writes a msgpack value as JSON, with the same conversions as convertRecordValue.
+func writeJsonValue(buf *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case string:
+		writeJsonString(buf, value)
+	case []byte:
+		writeJsonBytes(buf, value)
+	case bool:
+		buf.Write(strconv.AppendBool(buf.AvailableBuffer(), value))
+	case int:
+		buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(value), 10))
+	case int8:
+		buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(value), 10))
+	case int16:
+		buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(value), 10))
+	case int32:
+		buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(value), 10))
+	case int64:
+		buf.Write(strconv.AppendInt(buf.AvailableBuffer(), value, 10))
+	case uint:
+		buf.Write(strconv.AppendUint(buf.AvailableBuffer(), uint64(value), 10))
+	case uint8:
+		buf.Write(strconv.AppendUint(buf.AvailableBuffer(), uint64(value), 10))
+	case uint16:
+		buf.Write(strconv.AppendUint(buf.AvailableBuffer(), uint64(value), 10))
+	case uint32:
+		buf.Write(strconv.AppendUint(buf.AvailableBuffer(), uint64(value), 10))
+	case uint64:
+		buf.Write(strconv.AppendUint(buf.AvailableBuffer(), value, 10))
+	case float32:
+		writeJsonFloat(buf, float64(value), 32)
+	case float64:
+		writeJsonFloat(buf, value, 64)
+	case map[interface{}]interface{}:
+		buf.WriteByte('{')
+		for idx, key := range sortedKeys(value) {
+			if idx > 0 {
+				buf.WriteByte(',')
+			}
+			writeJsonString(buf, key.name)
+			buf.WriteByte(':')
+			writeJsonValue(buf, value[key.original])
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for idx, nested := range value {
+			if idx > 0 {
+				buf.WriteByte(',')
+			}
+			writeJsonValue(buf, nested)
+		}
+		buf.WriteByte(']')
+	default:
+		// Values that are decoded from JSON log lines or need conversion, such as timestamps, are rare enough to go through encoding/json.
+		encoded, err := json.Marshal(convertRecordValue(value))
+		if err != nil {
+			buf.WriteString("null")
+			return
+		}
+		buf.Write(encoded)
+	}
+}
+
+// writeJsonFloat formats floats like encoding/json, writing null for values that JSON cannot represent.
+func writeJsonFloat(buf *bytes.Buffer, value float64, bits int) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		buf.WriteString("null")
+		return
+	}
+	format := byte('f')
+	if abs := math.Abs(value); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	buf.Write(strconv.AppendFloat(buf.AvailableBuffer(), value, format, -1, bits))
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeJsonString writes s as a JSON string, replacing invalid UTF-8 like encoding/json does.
+func writeJsonString(buf *bytes.Buffer, s string) {
+	writeJsonText(buf, s, (*bytes.Buffer).WriteString, utf8.DecodeRuneInString)
+}
+
+// writeJsonBytes writes s as a JSON string like writeJsonString. Log lines are delivered by fluent-bit as bytes,
+// so they are written without converting them to a string first.
+func writeJsonBytes(buf *bytes.Buffer, s []byte) {
+	writeJsonText(buf, s, (*bytes.Buffer).Write, utf8.DecodeRune)
+}
+
+// writeJsonText escapes s, write and decodeRune are the variants of the type of s so unescaped text is written without a copy.
+func writeJsonText[T string | []byte](buf *bytes.Buffer, s T, write func(*bytes.Buffer, T) (int, error), decodeRune func(T) (rune, int)) {
+	buf.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+			_, _ = write(buf, s[start:i])
+			switch c {
+			case '"', '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			default:
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hexDigits[c>>4])
+				buf.WriteByte(hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := decodeRune(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			_, _ = write(buf, s[start:i])
+			buf.WriteString(`�`)
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	_, _ = write(buf, s[start:])
+	buf.WriteByte('"')
+}
+
+func convertToBatches(ctx context.Context, dec *output.FLBDecoder, operator *AzureOperator, chunk chunkID, tag string) ([]Batch, error) {
+	flush := trace.SpanContextFromContext(ctx)
+	_, span := operator.tracer().Start(ctx, spanConvert)
+	defer span.End()
+	builder := newBatchBuilder(operator, tag)
+	builder.chunk = chunk
+	records := 0
+	for {
+		ret, ts, record := output.GetRecord(dec)
+		if ret != 0 {
+			break
+		}
+		builder.add(record, getTimestampOrNow(ts))
+		records++
+	}
+	batches := builder.batches()
+	for idx := range batches {
+		batches[idx].Trace = flush
+	}
+	span.SetAttributes(
+		attribute.Int("azurelogsingestion.records", records),
+		attribute.Int("azurelogsingestion.records.dropped", builder.dropped),
+		attribute.Int("azurelogsingestion.batches", len(batches)),
+	)
+	return batches, nil
+}
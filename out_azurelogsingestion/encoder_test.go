@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+)
+
+var encoderTimestamp = time.Date(2025, 5, 12, 12, 0, 0, 123000000, time.UTC)
+
+func generateDummyRecord(idx int) map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"log":    []byte(fmt.Sprintf("2025-05-12T12:00:00Z INFO request %d handled in 12ms \"GET /api/items\"", idx)),
+		"stream": []byte("stdout"),
+		"kubernetes": map[interface{}]interface{}{
+			"pod_name":       []byte("api-7d9f8b6c5d-x2x4z"),
+			"namespace_name": []byte("default"),
+			"host":           []byte("aks-nodepool1-12345678-vmss000000"),
+			"docker_id":      []byte("0f3c1d2e4b5a69788796a5b4c3d2e1f00f3c1d2e4b5a69788796a5b4c3d2e1f0"),
+			"container_name": []byte("api"),
+			"labels": map[interface{}]interface{}{
+				"app": []byte("api"),
+			},
+		},
+	}
+}
+
+func TestColumnMapping_Encode_matchesConvert(t *testing.T) {
+	record := generateDummyRecord(1)
+	var buf bytes.Buffer
+
+	defaultColumnMapping.Encode(&buf, newRecordFields(record), encoderTimestamp)
+
+	expected, _ := json.Marshal(defaultColumnMapping.Convert(record, encoderTimestamp))
+	assert.JSONEq(t, string(expected), buf.String())
+}
+
+func TestPassthroughConverter_Encode_matchesConvert(t *testing.T) {
+	record := generateDummyRecord(1)
+	record["count"] = uint64(42)
+	record["ratio"] = 0.25
+	record["tiny"] = float32(1e-9)
+	record["ok"] = true
+	record["missing"] = nil
+	record["items"] = []interface{}{int8(-1), "two", map[interface{}]interface{}{"three": 3}}
+	record["time"] = output.FLBTime{Time: encoderTimestamp}
+	record[timeGeneratedColumn] = "ignored"
+	var buf bytes.Buffer
+
+	passthroughConverter{}.Encode(&buf, newRecordFields(record), encoderTimestamp)
+
+	expected, _ := json.Marshal(passthroughConverter{}.Convert(record, encoderTimestamp))
+	assert.JSONEq(t, string(expected), buf.String())
+}
+
+func TestPassthroughConverter_Encode_isDeterministic(t *testing.T) {
+	var first, second bytes.Buffer
+
+	passthroughConverter{}.Encode(&first, newRecordFields(generateDummyRecord(1)), encoderTimestamp)
+	passthroughConverter{}.Encode(&second, newRecordFields(generateDummyRecord(1)), encoderTimestamp)
+
+	assert.Equal(t, first.String(), second.String())
+}
+
+func TestWriteJsonString_escapesLikeEncodingJson(t *testing.T) {
+	values := []string{"plain", `quote " and \ backslash`, "new\nline\ttab\r", "\x00\x1f control", "émoji 🎉", "invalid \xff utf-8 \xe2\x82", "<html> & stuff"}
+	for _, value := range values {
+		var buf bytes.Buffer
+
+		writeJsonString(&buf, value)
+
+		var decoded string
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded), value)
+		expected, _ := json.Marshal(value)
+		var expectedDecoded string
+		_ = json.Unmarshal(expected, &expectedDecoded)
+		assert.Equal(t, expectedDecoded, decoded, value)
+	}
+}
+
+func TestWriteJsonBytes_matchesWriteJsonString(t *testing.T) {
+	values := []string{"plain", `quote " and \ backslash`, "new\nline\ttab\r", "\x00\x1f control", "émoji 🎉", "invalid \xff utf-8 \xe2\x82"}
+	for _, value := range values {
+		var fromString, fromBytes bytes.Buffer
+
+		writeJsonString(&fromString, value)
+		writeJsonBytes(&fromBytes, []byte(value))
+
+		assert.Equal(t, fromString.String(), fromBytes.String(), value)
+	}
+}
+
+func TestWriteJsonValue_unsupportedFloats_writesNull(t *testing.T) {
+	var buf bytes.Buffer
+
+	writeJsonValue(&buf, []interface{}{math.NaN(), math.Inf(1), 1e21, 1.5})
+
+	assert.Equal(t, `[null,null,1e+21,1.5]`, buf.String())
+}
+
+func TestBatchWriter_writeRow_cutsAtOneMegabyte(t *testing.T) {
+	var writer batchWriter
+	row := []byte(`"` + strings.Repeat("a", 300*1024) + `"`)
+
+	for range 7 {
+		writer.writeRow(row)
+	}
+	payloads := writer.finish()
+
+	assert.Len(t, payloads, 3)
+	for _, payload := range payloads {
+		assert.LessOrEqual(t, len(payload), oneMb)
+		var rows []string
+		assert.NoError(t, json.Unmarshal(payload, &rows))
+	}
+	releaseBatches([]Batch{{Payload: payloads[0]}})
+}
+
+func TestBatchWriter_smallPayload_doesNotHoldPooledBuffer(t *testing.T) {
+	var writer batchWriter
+	writer.writeRow([]byte(`{"log":"a single record"}`))
+
+	payloads := writer.finish()
+
+	assert.Len(t, payloads, 1)
+	assert.Equal(t, `[{"log":"a single record"}]`, string(payloads[0]))
+	assert.Less(t, cap(payloads[0]), oneMb/2)
+}
+
+func TestBatchBuilder_oversizedRecord_isTruncated(t *testing.T) {
+	oversized, _ := newOversizedRecords("", nil)
+	operator := &AzureOperator{
+		config:    AzureConfig{DcrImmutableId: "dcr-1", StreamName: "Custom-logs"},
+		converter: defaultColumnMapping,
+		oversized: oversized,
+	}
+	builder := newBatchBuilder(operator, "kube.app")
+
+	builder.add(map[interface{}]interface{}{"log": strings.Repeat("a", 2*oneMb)}, encoderTimestamp)
+	builder.add(generateDummyRecord(1), encoderTimestamp)
+	batches := builder.batches()
+
+	assert.Len(t, batches, 2)
+	for _, batch := range batches {
+		assert.LessOrEqual(t, len(batch.Payload), oneMb)
+	}
+	assert.Len(t, reverseEntries(t, [][]byte{batches[0].Payload, batches[1].Payload}), 2)
+}
+
+const benchmarkRecords = 10000
+
+func benchmarkRecordSet() []map[interface{}]interface{} {
+	records := make([]map[interface{}]interface{}, benchmarkRecords)
+	for idx := range records {
+		records[idx] = generateDummyRecord(idx)
+	}
+	return records
+}
+
+// reportPerMillionRecords reports the CPU time and allocations needed to encode a million records.
+func reportPerMillionRecords(b *testing.B, before runtime.MemStats) {
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	records := float64(b.N) * benchmarkRecords
+	b.ReportMetric(float64(b.Elapsed().Milliseconds())/records*1e6, "ms/1M-records")
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/records*1e6, "allocs/1M-records")
+	b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/records, "B/record")
+}
+
+// marshalEntries is the previous encoder, which marshals every entry with encoding/json before adding it to a batch.
+func marshalEntries(entries []FluentbitLogEntry) [][]byte {
+	var writer batchWriter
+	for _, entry := range entries {
+		jsonValue, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		writer.writeRow(jsonValue)
+	}
+	return writer.finish()
+}
+
+// BenchmarkEncode_entries measures the previous approach: building an entry per record and marshalling it.
+func BenchmarkEncode_entries(b *testing.B) {
+	for _, converter := range []RecordConverter{defaultColumnMapping, passthroughConverter{}} {
+		b.Run(fmt.Sprintf("%T", converter), func(b *testing.B) {
+			records := benchmarkRecordSet()
+			var before runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				entries := make([]FluentbitLogEntry, 0, len(records))
+				for _, record := range records {
+					entries = append(entries, converter.Convert(record, encoderTimestamp))
+				}
+				payloads := marshalEntries(entries)
+				for _, payload := range payloads {
+					releaseBatches([]Batch{{Payload: payload}})
+				}
+			}
+			b.StopTimer()
+			reportPerMillionRecords(b, before)
+		})
+	}
+}
+
+// BenchmarkEncode_streaming measures encoding the records straight into pooled batch buffers.
+func BenchmarkEncode_streaming(b *testing.B) {
+	for _, converter := range []RecordConverter{defaultColumnMapping, passthroughConverter{}} {
+		b.Run(fmt.Sprintf("%T", converter), func(b *testing.B) {
+			records := benchmarkRecordSet()
+			operator := &AzureOperator{
+				config:    AzureConfig{DcrImmutableId: "dcr-1", StreamName: "Custom-logs"},
+				converter: converter,
+			}
+			var before runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				builder := newBatchBuilder(operator, "kube.app")
+				for _, record := range records {
+					builder.add(record, encoderTimestamp)
+				}
+				releaseBatches(builder.batches())
+			}
+			b.StopTimer()
+			reportPerMillionRecords(b, before)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultHealthFailureThreshold = 5
+
+// uploadHealth tracks the upload results of an operator. A nil uploadHealth records nothing.
+type uploadHealth struct {
+	failureThreshold    int
+	lastSuccess         atomic.Int64
+	consecutiveFailures atomic.Int64
+	records             atomic.Int64
+	bytes               atomic.Int64
+	failures            atomic.Int64
+}
+
+func newUploadHealth(failureThreshold int) *uploadHealth {
+	return &uploadHealth{failureThreshold: failureThreshold}
+}
+
+func (h *uploadHealth) uploaded(now time.Time, size int, err error) {
+	if h == nil {
+		return
+	}
+	if err != nil {
+		h.consecutiveFailures.Add(1)
+		h.failures.Add(1)
+		return
+	}
+	h.consecutiveFailures.Store(0)
+	h.lastSuccess.Store(now.UnixNano())
+	h.bytes.Add(int64(size))
+}
+
+// recordsUploaded counts the records of a batch that Azure accepted.
+func (h *uploadHealth) recordsUploaded(count int) {
+	if h == nil {
+		return
+	}
+	h.records.Add(int64(count))
+}
+
+// lastUpload returns the time of the last successful upload, or the zero time when there is none.
+func (h *uploadHealth) lastUpload() time.Time {
+	if h == nil {
+		return time.Time{}
+	}
+	lastSuccess := h.lastSuccess.Load()
+	if lastSuccess == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastSuccess).UTC()
+}
+
+// instanceHealth is the state of an operator as reported by the health endpoints.
+type instanceHealth struct {
+	Id                   int        `json:"id"`
+	StreamName           string     `json:"stream_name"`
+	Ready                bool       `json:"ready"`
+	Reasons              []string   `json:"reasons,omitempty"`
+	Authenticated        bool       `json:"authenticated"`
+	TokenExpiresOn       *time.Time `json:"token_expires_on,omitempty"`
+	LastSuccessfulUpload *time.Time `json:"last_successful_upload,omitempty"`
+	ConsecutiveFailures  int64      `json:"consecutive_failures"`
+	QueuedBatches        int        `json:"queued_batches"`
+	QueuedBytes          int        `json:"queued_bytes"`
+}
+
+type healthReport struct {
+	Ready     bool             `json:"ready"`
+	Instances []instanceHealth `json:"instances"`
+}
+
+// health reports the state of the operator. It is not ready until it obtained a token
+// or when its consecutive upload failures reached the HealthFailureThreshold.
+// The token expiry is only reported, as the token is refreshed on the next upload and an idle output is not unhealthy.
+func (a *AzureOperator) health(id int) instanceHealth {
+	status := instanceHealth{
+		Id:            id,
+		StreamName:    a.config.StreamName,
+		Authenticated: a.credentials.authenticated(),
+	}
+	if expiresOn := a.credentials.tokenExpiresOn(); !expiresOn.IsZero() {
+		status.TokenExpiresOn = &expiresOn
+	}
+	if !status.Authenticated {
+		status.Reasons = append(status.Reasons, "not authenticated with Azure")
+	}
+	if a.queue != nil {
+		status.QueuedBatches, status.QueuedBytes = a.queue.depth()
+	}
+	if a.uploadHealth != nil {
+		if uploaded := a.uploadHealth.lastUpload(); !uploaded.IsZero() {
+			status.LastSuccessfulUpload = &uploaded
+		}
+		status.ConsecutiveFailures = a.uploadHealth.consecutiveFailures.Load()
+		if status.ConsecutiveFailures >= int64(a.uploadHealth.failureThreshold) {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("%d consecutive upload failures", status.ConsecutiveFailures))
+		}
+	}
+	status.Ready = len(status.Reasons) == 0
+	return status
+}
+
+func (r *operatorRegistry) health() healthReport {
+	report := healthReport{Ready: true, Instances: []instanceHealth{}}
+	for _, id := range r.ids() {
+		operator, ok := r.get(id)
+		if !ok {
+			continue
+		}
+		status := operator.health(id)
+		report.Ready = report.Ready && status.Ready
+		report.Instances = append(report.Instances, status)
+	}
+	return report
+}
+
+// healthHandler serves the health report of all operators. The liveness endpoint always responds with 200,
+// the readiness endpoint responds with 503 when any operator is not ready.
+func healthHandler(registry *operatorRegistry, readiness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := registry.health()
+		w.Header().Set("Content-Type", "application/json")
+		if readiness && !report.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Err(err).Msg("[azurelogsingestion] Failed to write health report")
+		}
+	})
+}
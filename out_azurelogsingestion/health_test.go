@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func newHealthTestOperator(t *testing.T) (*AzureOperator, *mocklogs.MockAzureLogsClient) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	operator := newTestOperator(mockClient, "Custom-logs")
+	operator.uploadHealth = newUploadHealth(2)
+	return operator, mockClient
+}
+
+func TestHealth_successfulUpload_isReady(t *testing.T) {
+	operator, mockClient := newHealthTestOperator(t)
+	operator.queue = newSendQueue(oneMb, 0)
+	assert.NoError(t, operator.queue.enqueue([]Batch{{Payload: []byte(`[{"log":"1"}]`)}}))
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, nil)
+
+	assert.NoError(t, operator.SendLogsTo(operator.config.defaultDestination(), []byte(`[]`)))
+	status := operator.health(3)
+
+	assert.True(t, status.Ready)
+	assert.Empty(t, status.Reasons)
+	assert.Equal(t, 3, status.Id)
+	assert.True(t, status.Authenticated)
+	assert.NotNil(t, status.LastSuccessfulUpload)
+	assert.Equal(t, int64(0), status.ConsecutiveFailures)
+	assert.Equal(t, 1, status.QueuedBatches)
+	assert.Equal(t, 13, status.QueuedBytes)
+}
+
+func TestHealth_consecutiveFailures_isNotReady(t *testing.T) {
+	operator, mockClient := newHealthTestOperator(t)
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(500, nil)).Times(2)
+
+	assert.Error(t, operator.SendLogsTo(operator.config.defaultDestination(), []byte(`[]`)))
+	assert.True(t, operator.health(0).Ready)
+	assert.Error(t, operator.SendLogsTo(operator.config.defaultDestination(), []byte(`[]`)))
+	status := operator.health(0)
+
+	assert.False(t, status.Ready)
+	assert.Equal(t, []string{"2 consecutive upload failures"}, status.Reasons)
+	assert.Nil(t, status.LastSuccessfulUpload)
+}
+
+func TestHealth_successAfterFailures_resetsFailures(t *testing.T) {
+	operator, mockClient := newHealthTestOperator(t)
+	gomock.InOrder(
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, errors.New("connection reset")).Times(2),
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, nil),
+	)
+
+	for range 3 {
+		_ = operator.SendLogsTo(operator.config.defaultDestination(), []byte(`[]`))
+	}
+
+	assert.True(t, operator.health(0).Ready)
+}
+
+func TestHealth_credential_reportsTokenExpiry(t *testing.T) {
+	operator, _ := newHealthTestOperator(t)
+	operator.credentials = newCredentialProvider(func() (azcore.TokenCredential, error) {
+		return &fakeCredential{failures: 1}, nil
+	}, tokenScope(cloud.AzurePublic))
+	operator.credentials.backoff = noBackoff
+
+	status := operator.health(0)
+	assert.False(t, status.Ready)
+	assert.Equal(t, []string{"not authenticated with Azure"}, status.Reasons)
+	assert.Nil(t, status.TokenExpiresOn)
+
+	operator.credentials.start()
+	defer operator.credentials.close()
+	assert.Eventually(t, operator.credentials.authenticated, time.Second, time.Millisecond)
+	status = operator.health(0)
+	assert.True(t, status.Ready)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *status.TokenExpiresOn, time.Minute)
+}
+
+func TestHealth_idleOutputWithExpiredToken_isReady(t *testing.T) {
+	operator, _ := newHealthTestOperator(t)
+	operator.credentials = newCredentialProvider(func() (azcore.TokenCredential, error) {
+		return &fakeCredential{expired: true}, nil
+	}, tokenScope(cloud.AzurePublic))
+	operator.credentials.start()
+	defer operator.credentials.close()
+	assert.Eventually(t, operator.credentials.authenticated, time.Second, time.Millisecond)
+
+	status := operator.health(0)
+
+	assert.True(t, status.Ready)
+	assert.Empty(t, status.Reasons)
+	assert.True(t, status.TokenExpiresOn.Before(time.Now()))
+}
+
+func TestHealthHandler_readiness_returnsUnavailableWhenAnyInstanceIsNotReady(t *testing.T) {
+	registry := newOperatorRegistry()
+	ready, _ := newHealthTestOperator(t)
+	failing, _ := newHealthTestOperator(t)
+	failing.uploadHealth.uploaded(time.Now(), 0, errors.New("connection reset"))
+	failing.uploadHealth.uploaded(time.Now(), 0, errors.New("connection reset"))
+	registry.register(ready)
+	registry.register(failing)
+
+	readiness := httptest.NewRecorder()
+	healthHandler(registry, true).ServeHTTP(readiness, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	liveness := httptest.NewRecorder()
+	healthHandler(registry, false).ServeHTTP(liveness, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, readiness.Code)
+	assert.Equal(t, http.StatusOK, liveness.Code)
+	var report healthReport
+	assert.NoError(t, json.Unmarshal(readiness.Body.Bytes(), &report))
+	assert.False(t, report.Ready)
+	assert.Len(t, report.Instances, 2)
+	assert.True(t, report.Instances[0].Ready)
+	assert.Equal(t, 1, report.Instances[1].Id)
+	assert.Equal(t, int64(2), report.Instances[1].ConsecutiveFailures)
+}
+
+func TestHealthHandler_noInstances_isReady(t *testing.T) {
+	recorder := httptest.NewRecorder()
+
+	healthHandler(newOperatorRegistry(), true).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"ready":true,"instances":[]}`, recorder.Body.String())
+}
@@ -0,0 +1,188 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultHeartbeatInterval = time.Minute
+
+// pluginVersion is set when the plugin is built, with -ldflags "-X main.pluginVersion=<version>".
+var pluginVersion = "dev"
+
+// heartbeatConfig holds where and how often an output sends its heartbeat. Heartbeats are disabled without a stream.
+type heartbeatConfig struct {
+	Destination Destination
+	Interval    time.Duration
+}
+
+// parseHeartbeatConfig reads the heartbeat keys of an output using get. The DCR and endpoint default to those of the output,
+// an output that only routes records needs its own HeartbeatDcrImmutableId and HeartbeatEndpoint.
+func parseHeartbeatConfig(get func(key string) string, output Destination) (heartbeatConfig, error) {
+	stream := get("heartbeatStream")
+	if stream == "" {
+		for _, key := range []string{"heartbeatInterval", "heartbeatEndpoint", "heartbeatDcrImmutableId"} {
+			if get(key) != "" {
+				return heartbeatConfig{}, errors.Errorf("%s requires HeartbeatStream to be configured", key)
+			}
+		}
+		return heartbeatConfig{}, nil
+	}
+	interval, err := parseDuration(get("heartbeatInterval"), defaultHeartbeatInterval)
+	if err != nil {
+		return heartbeatConfig{}, errors.Wrap(err, "invalid value for HeartbeatInterval")
+	}
+	destination := Destination{Endpoint: get("heartbeatEndpoint"), DcrImmutableId: get("heartbeatDcrImmutableId"), StreamName: stream}
+	if destination.Endpoint == "" {
+		destination.Endpoint = output.Endpoint
+	}
+	if destination.DcrImmutableId == "" {
+		destination.DcrImmutableId = output.DcrImmutableId
+	}
+	if destination.DcrImmutableId == "" {
+		return heartbeatConfig{}, errors.New("HeartbeatStream requires HeartbeatDcrImmutableId when the output has no DcrImmutableId")
+	}
+	if destination.Endpoint == "" {
+		return heartbeatConfig{}, errors.New("HeartbeatStream requires HeartbeatEndpoint when the output has no Endpoint")
+	}
+	return heartbeatConfig{Destination: destination, Interval: interval}, nil
+}
+
+// heartbeatRecord is the row sent to the heartbeat stream. The counters cover the period since the previous heartbeat
+// that was accepted, so summing them over a time range gives the totals of that range.
+type heartbeatRecord struct {
+	TimeGenerated string
+	Computer      string
+	PluginVersion string
+	Instance      int
+	StreamName    string
+	RecordsSent   int64
+	BytesSent     int64
+	UploadErrors  int64
+	QueuedBatches int
+	QueuedBytes   int
+	// LagSeconds is the time since the last successful upload, it is left out when nothing was uploaded yet.
+	LagSeconds    *float64 `json:",omitempty"`
+	Authenticated bool
+}
+
+type uploadTotals struct {
+	records, bytes, failures int64
+}
+
+// heartbeat periodically uploads a heartbeatRecord of its operator.
+type heartbeat struct {
+	config   heartbeatConfig
+	instance int
+	computer string
+	previous uploadTotals
+	stop     chan struct{}
+	done     sync.WaitGroup
+}
+
+func newHeartbeat(config heartbeatConfig, instance int) *heartbeat {
+	return &heartbeat{config: config, instance: instance, computer: nodeName(), stop: make(chan struct{})}
+}
+
+// nodeName returns the NODE_NAME environment variable, which the DaemonSet sets to the name of the Kubernetes node,
+// or the hostname when it is not set.
+func nodeName() string {
+	if name := os.Getenv("NODE_NAME"); name != "" {
+		return name
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func (h *heartbeat) record(a *AzureOperator, now time.Time) (heartbeatRecord, uploadTotals) {
+	totals := uploadTotals{}
+	if a.uploadHealth != nil {
+		totals = uploadTotals{records: a.uploadHealth.records.Load(), bytes: a.uploadHealth.bytes.Load(), failures: a.uploadHealth.failures.Load()}
+	}
+	record := heartbeatRecord{
+		TimeGenerated: now.UTC().Format(time.RFC3339Nano),
+		Computer:      h.computer,
+		PluginVersion: pluginVersion,
+		Instance:      h.instance,
+		StreamName:    a.config.StreamName,
+		RecordsSent:   totals.records - h.previous.records,
+		BytesSent:     totals.bytes - h.previous.bytes,
+		UploadErrors:  totals.failures - h.previous.failures,
+		Authenticated: a.credentials.authenticated(),
+	}
+	if a.queue != nil {
+		record.QueuedBatches, record.QueuedBytes = a.queue.depth()
+	}
+	if uploaded := a.uploadHealth.lastUpload(); !uploaded.IsZero() {
+		lag := now.Sub(uploaded).Seconds()
+		record.LagSeconds = &lag
+	}
+	return record, totals
+}
+
+// send uploads a heartbeat. It does not go through sendTo, so heartbeats do not count as uploads of the output
+// and a node whose logs fail to upload does not look healthy because its heartbeats succeed.
+func (h *heartbeat) send(a *AzureOperator, now time.Time) error {
+	record, totals := h.record(a, now)
+	body, err := json.Marshal([]heartbeatRecord{record})
+	if err != nil {
+		return err
+	}
+	destination := h.config.Destination
+	client, ok := a.clientFor(destination.Endpoint)
+	if !ok {
+		return errors.Errorf("endpoint %s of the heartbeat is not configured", destination.Endpoint)
+	}
+	if _, err := client.Upload(a.uploadContext(), destination.DcrImmutableId, destination.StreamName, body, nil); err != nil {
+		return errors.Wrapf(err, "failed to send heartbeat to stream %s", destination.StreamName)
+	}
+	h.previous = totals
+	return nil
+}
+
+// start sends a heartbeat every interval until the heartbeat is stopped. A failed heartbeat is not retried,
+// its counters are included in the next one.
+func (h *heartbeat) start(a *AzureOperator) {
+	h.done.Add(1)
+	go func() {
+		defer h.done.Done()
+		ticker := time.NewTicker(h.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case now := <-ticker.C:
+				if !a.credentials.authenticated() {
+					continue
+				}
+				if err := h.send(a, now); err != nil {
+					a.logger.Warn().Err(err).Msg("[azurelogsingestion] Failed to send heartbeat")
+				}
+			}
+		}
+	}()
+}
+
+func (h *heartbeat) close() {
+	close(h.stop)
+	h.done.Wait()
+}
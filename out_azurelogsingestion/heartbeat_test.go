@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+var heartbeatDestination = Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-heartbeat"}
+
+func newHeartbeatTestOperator(t *testing.T) (*AzureOperator, *mocklogs.MockAzureLogsClient) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	operator := newTestOperator(mockClient, "Custom-logs")
+	operator.uploadHealth = newUploadHealth(defaultHealthFailureThreshold)
+	return operator, mockClient
+}
+
+// expectHeartbeat decodes the heartbeat that is uploaded next into record.
+func expectHeartbeat(mockClient *mocklogs.MockAzureLogsClient, record *heartbeatRecord, err error) {
+	mockClient.EXPECT().Upload(gomock.Any(), "dcr-1", "Custom-heartbeat", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ any, _ string, _ string, body []byte, _ *azlogs.UploadOptions) (azlogs.UploadResponse, error) {
+			var records []heartbeatRecord
+			if decodeErr := json.Unmarshal(body, &records); decodeErr == nil && len(records) == 1 {
+				*record = records[0]
+			}
+			return azlogs.UploadResponse{}, err
+		})
+}
+
+func TestParseHeartbeatConfig_defaultsToOutputDcr(t *testing.T) {
+	output := Destination{Endpoint: "https://default", DcrImmutableId: "dcr-1", StreamName: "Custom-logs"}
+
+	config, err := parseHeartbeatConfig(authKeys(map[string]string{}), output)
+	assert.NoError(t, err)
+	assert.Equal(t, heartbeatConfig{}, config)
+
+	config, err = parseHeartbeatConfig(authKeys(map[string]string{"heartbeatStream": "Custom-heartbeat"}), output)
+	assert.NoError(t, err)
+	assert.Equal(t, heartbeatConfig{Destination: Destination{Endpoint: "https://default", DcrImmutableId: "dcr-1", StreamName: "Custom-heartbeat"}, Interval: time.Minute}, config)
+
+	config, err = parseHeartbeatConfig(authKeys(map[string]string{
+		"heartbeatStream":         "Custom-heartbeat",
+		"heartbeatDcrImmutableId": "dcr-2",
+		"heartbeatEndpoint":       "https://other",
+		"heartbeatInterval":       "30s",
+	}), output)
+	assert.NoError(t, err)
+	assert.Equal(t, heartbeatConfig{Destination: Destination{Endpoint: "https://other", DcrImmutableId: "dcr-2", StreamName: "Custom-heartbeat"}, Interval: 30 * time.Second}, config)
+
+	_, err = parseHeartbeatConfig(authKeys(map[string]string{"heartbeatStream": "Custom-heartbeat", "heartbeatInterval": "often"}), output)
+	assert.Error(t, err)
+}
+
+func TestParseHeartbeatConfig_unresolvableDestination_returnsError(t *testing.T) {
+	routesOnly := Destination{Endpoint: "https://default"}
+
+	_, err := parseHeartbeatConfig(authKeys(map[string]string{"heartbeatStream": "Custom-heartbeat"}), routesOnly)
+	assert.ErrorContains(t, err, "requires HeartbeatDcrImmutableId")
+
+	config, err := parseHeartbeatConfig(authKeys(map[string]string{"heartbeatStream": "Custom-heartbeat", "heartbeatDcrImmutableId": "dcr-2"}), routesOnly)
+	assert.NoError(t, err)
+	assert.Equal(t, Destination{Endpoint: "https://default", DcrImmutableId: "dcr-2", StreamName: "Custom-heartbeat"}, config.Destination)
+
+	_, err = parseHeartbeatConfig(authKeys(map[string]string{"heartbeatDcrImmutableId": "dcr-2"}), routesOnly)
+	assert.ErrorContains(t, err, "requires HeartbeatStream")
+}
+
+func TestHeartbeat_send_reportsUploadsSincePreviousHeartbeat(t *testing.T) {
+	operator, mockClient := newHeartbeatTestOperator(t)
+	heartbeat := newHeartbeat(heartbeatConfig{Destination: heartbeatDestination, Interval: time.Minute}, 4)
+	heartbeat.computer = "aks-node-1"
+	now := time.Date(2025, 5, 12, 12, 0, 0, 0, time.UTC)
+	mockClient.EXPECT().Upload(gomock.Any(), "dcr-1", "Custom-logs", gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, nil)
+	mockClient.EXPECT().Upload(gomock.Any(), "dcr-1", "Custom-logs", gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, errors.New("connection reset"))
+	assert.NoError(t, operator.send(Batch{Destination: operator.config.defaultDestination(), Payload: []byte(`[{"log":"1"},{"log":"2"}]`), Records: 2}))
+	assert.Error(t, operator.send(Batch{Destination: operator.config.defaultDestination(), Payload: []byte(`[{"log":"3"}]`), Records: 1}))
+	lastUpload := operator.uploadHealth.lastUpload()
+
+	var first, second heartbeatRecord
+	expectHeartbeat(mockClient, &first, nil)
+	expectHeartbeat(mockClient, &second, nil)
+	assert.NoError(t, heartbeat.send(operator, now))
+	assert.NoError(t, heartbeat.send(operator, now.Add(time.Minute)))
+
+	assert.Equal(t, "aks-node-1", first.Computer)
+	assert.Equal(t, pluginVersion, first.PluginVersion)
+	assert.Equal(t, 4, first.Instance)
+	assert.Equal(t, "Custom-logs", first.StreamName)
+	assert.Equal(t, int64(2), first.RecordsSent)
+	assert.Equal(t, int64(25), first.BytesSent)
+	assert.Equal(t, int64(1), first.UploadErrors)
+	assert.True(t, first.Authenticated)
+	assert.NotNil(t, first.LagSeconds)
+	assert.Equal(t, int64(0), second.RecordsSent)
+	assert.Equal(t, int64(0), second.UploadErrors)
+	assert.Equal(t, lastUpload, operator.uploadHealth.lastUpload())
+}
+
+func TestHeartbeat_failedSend_keepsCountersForNextHeartbeat(t *testing.T) {
+	operator, mockClient := newHeartbeatTestOperator(t)
+	heartbeat := newHeartbeat(heartbeatConfig{Destination: heartbeatDestination, Interval: time.Minute}, 0)
+	operator.uploadHealth.recordsUploaded(10)
+
+	var failed, retried heartbeatRecord
+	expectHeartbeat(mockClient, &failed, responseError(503, nil))
+	expectHeartbeat(mockClient, &retried, nil)
+	assert.Error(t, heartbeat.send(operator, time.Now()))
+	assert.NoError(t, heartbeat.send(operator, time.Now()))
+
+	assert.Equal(t, int64(10), retried.RecordsSent)
+	assert.Nil(t, retried.LagSeconds)
+	assert.Equal(t, int64(0), operator.uploadHealth.failures.Load())
+}
+
+func TestHeartbeat_start_sendsUntilClosed(t *testing.T) {
+	operator, mockClient := newHeartbeatTestOperator(t)
+	heartbeat := newHeartbeat(heartbeatConfig{Destination: heartbeatDestination, Interval: 10 * time.Millisecond}, 0)
+	sent := make(chan struct{}, 100)
+	mockClient.EXPECT().Upload(gomock.Any(), "dcr-1", "Custom-heartbeat", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ any, _ string, _ string, _ []byte, _ *azlogs.UploadOptions) (azlogs.UploadResponse, error) {
+			sent <- struct{}{}
+			return azlogs.UploadResponse{}, nil
+		}).MinTimes(1)
+
+	heartbeat.start(operator)
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeat was sent")
+	}
+	heartbeat.close()
+}
@@ -0,0 +1,232 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout matches the default grace period of fluent-bit.
+const defaultDrainTimeout = 5 * time.Second
+
+// operatorRegistry holds the operator of every output instance, keyed by the id stored in the fluent-bit context.
+// Fluent-bit initializes, flushes and exits instances from different threads, so all access is synchronized.
+type operatorRegistry struct {
+	mutex     sync.RWMutex
+	nextID    int
+	operators map[int]*AzureOperator
+}
+
+func newOperatorRegistry() *operatorRegistry {
+	return &operatorRegistry{operators: map[int]*AzureOperator{}}
+}
+
+func (r *operatorRegistry) register(operator *AzureOperator) int {
+	id := r.reserve()
+	r.store(id, operator)
+	return id
+}
+
+// reserve returns the id for an operator that is still being created, so the operator can use it in its metrics.
+func (r *operatorRegistry) reserve() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	id := r.nextID
+	r.nextID++
+	return id
+}
+
+func (r *operatorRegistry) store(id int, operator *AzureOperator) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.operators[id] = operator
+}
+
+func (r *operatorRegistry) get(id int) (*AzureOperator, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	operator, ok := r.operators[id]
+	return operator, ok
+}
+
+// remove takes the operator out of the registry, so no new flushes reach it while it is closed.
+func (r *operatorRegistry) remove(id int) (*AzureOperator, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	operator, ok := r.operators[id]
+	delete(r.operators, id)
+	return operator, ok
+}
+
+// ids returns the ids of the registered operators in the order they were registered.
+func (r *operatorRegistry) ids() []int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.sortedIDs()
+}
+
+func (r *operatorRegistry) sortedIDs() []int {
+	ids := make([]int, 0, len(r.operators))
+	for id := range r.operators {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// removeAll takes all operators out of the registry.
+func (r *operatorRegistry) removeAll() map[int]*AzureOperator {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	operators := r.operators
+	r.operators = map[int]*AzureOperator{}
+	return operators
+}
+
+// shutdown closes all operators concurrently under one deadline once fluent-bit exits the first instance.
+// Fluent-bit calls the exit callback of the instances one after the other, so closing every operator in its own
+// callback would make stopping fluent-bit take the sum of their drain timeouts.
+type shutdown struct {
+	mutex   sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	closing map[int]<-chan error
+}
+
+// exit waits until the operator of the instance is closed and returns false when the instance is unknown.
+// The first call takes all operators out of the registry and starts closing them, the call that exits the last
+// of them stops the metrics and health endpoints.
+func (s *shutdown) exit(registry *operatorRegistry, id int) (bool, error) {
+	s.mutex.Lock()
+	if s.closing == nil {
+		operators := registry.removeAll()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout(operators))
+		s.ctx, s.cancel = ctx, cancel
+		s.closing = make(map[int]<-chan error, len(operators))
+		for operatorID, operator := range operators {
+			closed := make(chan error, 1)
+			go func() {
+				closed <- operator.closeBefore(ctx)
+			}()
+			s.closing[operatorID] = closed
+		}
+	}
+	closed, ok := s.closing[id]
+	delete(s.closing, id)
+	ctx, cancel := s.ctx, s.cancel
+	last := len(s.closing) == 0
+	if last {
+		s.closing = nil
+	}
+	s.mutex.Unlock()
+
+	var err error
+	if ok {
+		err = <-closed
+	}
+	if last {
+		stopMonitoringServers(ctx)
+		cancel()
+	}
+	return ok, err
+}
+
+// shutdownTimeout is the time that closing the operators may take, which is the longest drain timeout
+// and at least the default grace period of fluent-bit.
+func shutdownTimeout(operators map[int]*AzureOperator) time.Duration {
+	timeout := defaultDrainTimeout
+	for _, operator := range operators {
+		timeout = max(timeout, operator.config.DrainTimeout)
+	}
+	return timeout
+}
+
+// Close uploads the batches that are still queued, stops the background work of the operator and releases its connections.
+// Uploads that have not finished within the drain timeout are cancelled, their batches are stored in the spool when it is configured.
+// It is safe to call Close more than once.
+func (a *AzureOperator) Close() error {
+	return a.closeBefore(context.Background())
+}
+
+// closeBefore closes the operator like Close, but stops draining when ctx is done before the drain timeout expires.
+func (a *AzureOperator) closeBefore(ctx context.Context) error {
+	var err error
+	a.closeOnce.Do(func() {
+		drainCtx, cancelDrain := context.WithTimeout(ctx, a.config.DrainTimeout)
+		defer cancelDrain()
+		stopUploads := context.AfterFunc(drainCtx, a.cancelUploads)
+		defer stopUploads()
+
+		if a.heartbeat != nil {
+			a.heartbeat.close()
+		}
+		if a.spool != nil {
+			a.spool.stopReplay()
+		}
+		if a.queue != nil {
+			pending, bytes := a.queue.depth()
+			if pending > 0 {
+				a.logger.Info().Msgf("[azurelogsingestion] Uploading %d queued batches (%d bytes) before closing", pending, bytes)
+			}
+			a.queue.close(drainCtx, a.abandon)
+		}
+		a.cancelUploads()
+		if a.credentials != nil {
+			a.credentials.close()
+		}
+		if a.deadLetter != nil {
+			err = a.deadLetter.close()
+		}
+		if a.httpClient != nil {
+			a.httpClient.CloseIdleConnections()
+		}
+		shutdownCtx, cancelShutdown := context.WithTimeout(ctx, defaultDrainTimeout)
+		defer cancelShutdown()
+		if shutdownErr := a.shutdownTracing(shutdownCtx); shutdownErr != nil {
+			a.logger.Err(shutdownErr).Msg("[azurelogsingestion] Failed to export the remaining spans")
+		}
+	})
+	return err
+}
+
+// uploadContext is cancelled when the operator is closed and its uploads did not finish within the drain timeout.
+func (a *AzureOperator) uploadContext() context.Context {
+	if a.uploadCtx == nil {
+		return context.Background()
+	}
+	return a.uploadCtx
+}
+
+func (a *AzureOperator) cancelUploads() {
+	if a.cancelUploadCtx != nil {
+		a.cancelUploadCtx()
+	}
+}
+
+// abandon stores a batch that could not be uploaded before the drain timeout in the spool, or reports it as lost.
+func (a *AzureOperator) abandon(batch Batch) {
+	if a.spool == nil {
+		a.logger.Error().Msgf("[azurelogsingestion] Drain timeout expired, dropping batch of %d bytes for stream %s", len(batch.Payload), batch.Destination.StreamName)
+		a.metrics.recordsDropped(batch.Destination, dropReasonDrainTimeout, batch.Records)
+		return
+	}
+	if err := a.spool.store(batch); err != nil {
+		a.logger.Err(err).Msgf("[azurelogsingestion] Drain timeout expired, failed to spool batch for stream %s", batch.Destination.StreamName)
+		a.metrics.recordsDropped(batch.Destination, dropReasonDrainTimeout, batch.Records)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+	"go.uber.org/mock/gomock"
+)
+
+// encodeChunk encodes records the way fluent-bit passes them to FLBPluginFlushCtx.
+func encodeChunk(t *testing.T, logs ...string) []byte {
+	var chunk []byte
+	encoder := codec.NewEncoderBytes(&chunk, &codec.MsgpackHandle{})
+	for _, log := range logs {
+		assert.NoError(t, encoder.Encode([]interface{}{uint64(1747051200), map[string]interface{}{"log": log}}))
+	}
+	return chunk
+}
+
+func flushChunk(id int, chunk []byte) int {
+	return flushInstance(id, unsafe.Pointer(&chunk[0]), len(chunk), "kube.app")
+}
+
+func newTestOperator(client *mocklogs.MockAzureLogsClient, stream string) *AzureOperator {
+	return &AzureOperator{
+		config:     AzureConfig{Endpoint: spoolDestination.Endpoint, DcrImmutableId: "dcr-1", StreamName: stream, DrainTimeout: time.Second},
+		converter:  defaultColumnMapping,
+		logsClient: client,
+		uploads:    newUploadPool(1),
+		httpClient: newHTTPClient(transportConfig{}),
+	}
+}
+
+func TestOperatorRegistry_concurrentRegister_assignsUniqueIds(t *testing.T) {
+	registry := newOperatorRegistry()
+	ids := make(chan int, 50)
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids <- registry.register(&AzureOperator{})
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[int]bool{}
+	for id := range ids {
+		assert.False(t, seen[id])
+		seen[id] = true
+		_, ok := registry.get(id)
+		assert.True(t, ok)
+	}
+	assert.Len(t, registry.removeAll(), 50)
+	assert.Empty(t, registry.operators)
+}
+
+func TestInstances_initFlushExit_eachUsesOwnOperator(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	syncClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	queuedClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	syncOperator := newTestOperator(syncClient, "Custom-sync")
+	queuedOperator := newTestOperator(queuedClient, "Custom-queued")
+	queuedOperator.queue = newSendQueue(oneMb, 10)
+	queuedOperator.queue.start(1, queuedOperator.deliverQueued)
+	syncId := azureLogOperators.register(syncOperator)
+	queuedId := azureLogOperators.register(queuedOperator)
+
+	syncClient.EXPECT().Upload(gomock.Any(), "dcr-1", "Custom-sync", gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, nil)
+	queuedClient.EXPECT().Upload(gomock.Any(), "dcr-1", "Custom-queued", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ any, _ string, _ string, body []byte, _ *azlogs.UploadOptions) (azlogs.UploadResponse, error) {
+			time.Sleep(50 * time.Millisecond)
+			assert.Len(t, reverseEntries(t, [][]byte{body}), 2)
+			return azlogs.UploadResponse{}, nil
+		})
+
+	assert.Equal(t, output.FLB_OK, flushChunk(syncId, encodeChunk(t, "sync")))
+	assert.Equal(t, output.FLB_OK, flushChunk(queuedId, encodeChunk(t, "queued 1", "queued 2")))
+	assert.Equal(t, output.FLB_OK, exitInstance(queuedId))
+	assert.Equal(t, output.FLB_OK, exitInstance(syncId))
+
+	pending, _ := queuedOperator.queue.depth()
+	assert.Zero(t, pending)
+	assert.Equal(t, output.FLB_ERROR, flushChunk(syncId, encodeChunk(t, "after exit")))
+	assert.Equal(t, output.FLB_OK, exitInstance(syncId))
+}
+
+func TestClose_stopsSpoolReplayAndClosesDeadLetterFile(t *testing.T) {
+	batchSpool, err := newSpool(t.TempDir(), 0, "")
+	assert.NoError(t, err)
+	sink, err := newDeadLetterSink(t.TempDir(), 0, time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, sink.write(Batch{Destination: spoolDestination, Payload: []byte(`[]`)}, assert.AnError))
+	operator := &AzureOperator{spool: batchSpool, deadLetter: sink}
+	batchSpool.startReplay(time.Hour, func(Batch) error { return nil })
+
+	assert.NoError(t, operator.Close())
+	assert.NoError(t, operator.Close())
+
+	assert.Nil(t, batchSpool.stop)
+	assert.Nil(t, sink.file)
+}
+
+func TestSendQueue_close_rejectsNewBatches(t *testing.T) {
+	queue := newSendQueue(oneMb, 10)
+	queue.start(1, func(Batch, int) error { return nil })
+
+	queue.close(context.Background(), nil)
+
+	assert.ErrorIs(t, queue.enqueue([]Batch{{Payload: []byte("[]")}}), errQueueClosed)
+}
+
+func TestSendQueue_close_abandonsBatchesAfterDeadline(t *testing.T) {
+	queue := newSendQueue(oneMb, 10)
+	queue.start(1, func(Batch, int) error { return errors.New("azure unavailable") })
+	assert.NoError(t, queue.enqueue([]Batch{{Payload: []byte(`[1]`)}, {Payload: []byte(`[2]`)}}))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var abandoned []string
+
+	queue.close(ctx, func(batch Batch) {
+		abandoned = append(abandoned, string(batch.Payload))
+	})
+
+	assert.Equal(t, []string{`[1]`, `[2]`}, abandoned)
+	pending, bytes := queue.depth()
+	assert.Zero(t, pending)
+	assert.Zero(t, bytes)
+}
+
+func TestClose_drainTimeout_cancelsUploadAndSpoolsBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	batchSpool, err := newSpool(t.TempDir(), 0, "")
+	assert.NoError(t, err)
+	operator := newTestOperator(mockClient, "Custom-logs")
+	operator.config.DrainTimeout = 50 * time.Millisecond
+	operator.spool = batchSpool
+	operator.uploadCtx, operator.cancelUploadCtx = context.WithCancel(context.Background())
+	operator.queue = newSendQueue(oneMb, 10)
+	operator.queue.start(1, operator.deliverQueued)
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, _ string, _ string, _ []byte, _ *azlogs.UploadOptions) (azlogs.UploadResponse, error) {
+			<-ctx.Done()
+			return azlogs.UploadResponse{}, ctx.Err()
+		})
+	assert.NoError(t, operator.queue.enqueue([]Batch{{Destination: spoolDestination, Payload: []byte(`[{"log":"in flight"}]`)}}))
+
+	start := time.Now()
+	assert.NoError(t, operator.Close())
+
+	assert.Less(t, time.Since(start), time.Second)
+	files, err := batchSpool.files()
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestShutdown_exit_closesAllOperatorsConcurrently(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	registry := newOperatorRegistry()
+	var operators []*AzureOperator
+	for range 3 {
+		mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, _ string, _ string, _ []byte, _ *azlogs.UploadOptions) (azlogs.UploadResponse, error) {
+				<-ctx.Done()
+				return azlogs.UploadResponse{}, ctx.Err()
+			})
+		operator := newTestOperator(mockClient, "Custom-logs")
+		operator.config.DrainTimeout = 200 * time.Millisecond
+		operator.uploadCtx, operator.cancelUploadCtx = context.WithCancel(context.Background())
+		operator.queue = newSendQueue(oneMb, 10)
+		operator.queue.start(1, operator.deliverQueued)
+		assert.NoError(t, operator.queue.enqueue([]Batch{{Destination: spoolDestination, Payload: []byte(`[{"log":"in flight"}]`)}}))
+		registry.register(operator)
+		operators = append(operators, operator)
+	}
+	var s shutdown
+
+	start := time.Now()
+	for _, id := range registry.ids() {
+		ok, err := s.exit(registry, id)
+		assert.True(t, ok)
+		assert.NoError(t, err)
+	}
+
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Empty(t, registry.ids())
+	for _, operator := range operators {
+		pending, _ := operator.queue.depth()
+		assert.Zero(t, pending)
+	}
+	ok, err := s.exit(registry, 0)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+}
+
+func TestShutdown_exitLastInstance_stopsMonitoringServers(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+	defer stopMonitoringServers(context.Background())
+	registry := newOperatorRegistry()
+	first := registry.register(newTestOperator(nil, "Custom-first"))
+	second := registry.register(newTestOperator(nil, "Custom-second"))
+	_, err = startMonitoringServer(address)
+	assert.NoError(t, err)
+	var s shutdown
+
+	_, err = s.exit(registry, first)
+	assert.NoError(t, err)
+	monitoringServers.Lock()
+	assert.Contains(t, monitoringServers.servers, address)
+	monitoringServers.Unlock()
+	_, err = s.exit(registry, second)
+	assert.NoError(t, err)
+
+	monitoringServers.Lock()
+	defer monitoringServers.Unlock()
+	assert.NotContains(t, monitoringServers.servers, address)
+}
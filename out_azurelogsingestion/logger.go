@@ -0,0 +1,77 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	logFormatJson    = "json"
+	logFormatConsole = "console"
+)
+
+// defaultLogLevel is the default log level of fluent-bit.
+const defaultLogLevel = zerolog.InfoLevel
+
+// logOutput is where the loggers of all outputs write to, fluent-bit writes its own logs to stderr as well.
+var logOutput io.Writer = os.Stderr
+
+func init() {
+	// Messages that do not belong to an output, such as the registration of the plugin, are logged at the default level.
+	log.Logger = log.Logger.Level(defaultLogLevel)
+}
+
+// loggerConfig holds the log settings of an output.
+type loggerConfig struct {
+	Level  zerolog.Level
+	Format string
+}
+
+// parseLoggerConfig reads the LogLevel and LogFormat keys of an output using get. LogLevel is the only setting that
+// controls the level, as fluent-bit does not pass its own log_level to Go plugins.
+func parseLoggerConfig(get func(key string) string) (loggerConfig, error) {
+	config := loggerConfig{Level: defaultLogLevel, Format: get("logFormat")}
+	if value := get("logLevel"); value != "" {
+		level, err := zerolog.ParseLevel(value)
+		if err != nil || level == zerolog.NoLevel {
+			return loggerConfig{}, fmt.Errorf("invalid value for LogLevel %q, expected trace, debug, info, warn, error or disabled", value)
+		}
+		config.Level = level
+	}
+	switch config.Format {
+	case "":
+		config.Format = logFormatJson
+	case logFormatJson, logFormatConsole:
+	default:
+		return loggerConfig{}, fmt.Errorf("unknown LogFormat %q, expected %s or %s", config.Format, logFormatJson, logFormatConsole)
+	}
+	return config, nil
+}
+
+// newInstanceLogger creates the logger of an output. Its level only applies to the output, so outputs with different
+// LogLevel settings do not affect each other.
+func newInstanceLogger(config loggerConfig, id int, stream string) zerolog.Logger {
+	out := logOutput
+	if config.Format == logFormatConsole {
+		out = zerolog.ConsoleWriter{Out: logOutput, NoColor: true}
+	}
+	return zerolog.New(out).Level(config.Level).With().Timestamp().Int("instance", id).Str("stream", stream).Logger()
+}
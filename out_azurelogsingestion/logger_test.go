@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func withLogOutput(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := logOutput
+	logOutput = &buf
+	t.Cleanup(func() { logOutput = previous })
+	return &buf
+}
+
+func TestParseLoggerConfig_default_usesFluentbitDefaults(t *testing.T) {
+	config, err := parseLoggerConfig(authKeys(map[string]string{}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, loggerConfig{Level: zerolog.InfoLevel, Format: logFormatJson}, config)
+}
+
+func TestParseLoggerConfig_logLevel_setsLevelAndFormat(t *testing.T) {
+	config, err := parseLoggerConfig(authKeys(map[string]string{"logLevel": "error", "logFormat": "console"}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, loggerConfig{Level: zerolog.ErrorLevel, Format: logFormatConsole}, config)
+}
+
+func TestParseLoggerConfig_invalid_returnsError(t *testing.T) {
+	_, err := parseLoggerConfig(authKeys(map[string]string{"logLevel": "verbose"}))
+	assert.ErrorContains(t, err, "invalid value for LogLevel")
+
+	_, err = parseLoggerConfig(authKeys(map[string]string{"logFormat": "logfmt"}))
+	assert.ErrorContains(t, err, "unknown LogFormat")
+}
+
+func TestNewInstanceLogger_levels_areIndependent(t *testing.T) {
+	buf := withLogOutput(t)
+	globalLevel := zerolog.GlobalLevel()
+	debug := newInstanceLogger(loggerConfig{Level: zerolog.DebugLevel, Format: logFormatJson}, 0, "Custom-debug")
+	errorOnly := newInstanceLogger(loggerConfig{Level: zerolog.ErrorLevel, Format: logFormatJson}, 1, "Custom-error")
+
+	debug.Debug().Msg("visible")
+	errorOnly.Warn().Msg("hidden")
+
+	assert.Equal(t, globalLevel, zerolog.GlobalLevel())
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 1)
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "visible", entry["message"])
+	assert.Equal(t, float64(0), entry["instance"])
+	assert.Equal(t, "Custom-debug", entry["stream"])
+}
+
+func TestNewInstanceLogger_console_writesText(t *testing.T) {
+	buf := withLogOutput(t)
+	logger := newInstanceLogger(loggerConfig{Level: zerolog.InfoLevel, Format: logFormatConsole}, 2, "Custom-logs")
+
+	logger.Info().Msg("started")
+
+	assert.Contains(t, buf.String(), "started")
+	assert.Contains(t, buf.String(), "instance=2")
+	assert.False(t, json.Valid(buf.Bytes()))
+}
+
+func TestFlushInstance_logs_includeTag(t *testing.T) {
+	var buf bytes.Buffer
+	ctrl := gomock.NewController(t)
+	operator := newTestOperator(mocklogs.NewMockAzureLogsClient(ctrl), "Custom-logs")
+	operator.logger = zerolog.New(&buf).With().Int("instance", 7).Logger()
+	operator.credentials = newCredentialProvider(func() (azcore.TokenCredential, error) {
+		return &fakeCredential{}, nil
+	}, tokenScope(cloud.AzurePublic))
+	id := azureLogOperators.register(operator)
+	defer exitInstance(id)
+
+	assert.Equal(t, output.FLB_RETRY, flushChunk(id, encodeChunk(t, "degraded")))
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "kube.app", entry["tag"])
+	assert.Equal(t, float64(7), entry["instance"])
+	assert.Equal(t, "warn", entry["level"])
+}
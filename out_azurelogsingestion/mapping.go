@@ -0,0 +1,241 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const timeGeneratedColumn = "TimeGenerated"
+
+// Column maps a value in a fluent-bit record to a column in the DCR stream.
+type Column struct {
+	Name string
+	Path []string
+	// Required columns are always sent, as an empty string when the record does not contain the value.
+	Required bool
+}
+
+// ColumnMapping describes which record values are sent to Azure and under which column name.
+type ColumnMapping []Column
+
+// defaultColumnMapping matches the columns created by the scripts in this repository.
+// Like before mappings were configurable, the log column is always sent.
+var defaultColumnMapping = ColumnMapping{
+	{Name: "kubernetes_pod_name", Path: []string{"kubernetes", "pod_name"}},
+	{Name: "kubernetes_namespace_name", Path: []string{"kubernetes", "namespace_name"}},
+	{Name: "kubernetes_host", Path: []string{"kubernetes", "host"}},
+	{Name: "kubernetes_docker_id", Path: []string{"kubernetes", "docker_id"}},
+	{Name: "kubernetes_container_name", Path: []string{"kubernetes", "container_name"}},
+	{Name: "log", Path: []string{"log"}, Required: true},
+	{Name: "stream", Path: []string{"stream"}},
+}
+
+// loadColumnMapping builds the mapping from the inline Mapping key or the MappingFile key.
+// When neither is configured, the default mapping is returned.
+func loadColumnMapping(inline string, file string) (ColumnMapping, error) {
+	if inline != "" && file != "" {
+		return nil, errors.New("only one of Mapping and MappingFile can be configured")
+	}
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read mapping file %s", file)
+		}
+		inline = string(content)
+	}
+	if strings.TrimSpace(inline) == "" {
+		return defaultColumnMapping, nil
+	}
+	return parseColumnMapping(inline)
+}
+
+// parseColumnMapping parses column definitions of the form column=record.path,
+// separated by commas or newlines. Lines starting with # are ignored.
+func parseColumnMapping(spec string) (ColumnMapping, error) {
+	var mapping ColumnMapping
+	seen := map[string]bool{}
+	for _, line := range strings.Split(spec, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, definition := range strings.Split(line, ",") {
+			definition = strings.TrimSpace(definition)
+			if definition == "" {
+				continue
+			}
+			name, rawPath, found := strings.Cut(definition, "=")
+			name = strings.TrimSpace(name)
+			if !found || name == "" {
+				return nil, fmt.Errorf("invalid column definition %q, expected column=record.path", definition)
+			}
+			if name == timeGeneratedColumn {
+				return nil, fmt.Errorf("column %s is always set by the plugin and cannot be mapped", timeGeneratedColumn)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("column %s is mapped more than once", name)
+			}
+			path, err := parseRecordPath(strings.TrimSpace(rawPath))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid path for column %s", name)
+			}
+			seen[name] = true
+			mapping = append(mapping, Column{Name: name, Path: path})
+		}
+	}
+	return mapping, nil
+}
+
+// parseRecordPath splits a path like kubernetes.labels['app.kubernetes.io/name'] into its keys.
+// Bracketed keys may contain dots.
+func parseRecordPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, errors.New("path is empty")
+	}
+	var keys []string
+	var current strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '.':
+			if current.Len() > 0 {
+				keys = append(keys, current.String())
+				current.Reset()
+			} else if i == 0 || path[i-1] != ']' {
+				return nil, fmt.Errorf("empty key in path %q", path)
+			}
+		case '[':
+			if current.Len() > 0 {
+				keys = append(keys, current.String())
+				current.Reset()
+			}
+			end := strings.Index(path[i:], "']")
+			if !strings.HasPrefix(path[i:], "['") || end < 0 {
+				return nil, fmt.Errorf("unterminated bracket in path %q", path)
+			}
+			keys = append(keys, path[i+2:i+end])
+			i += end + 1
+		default:
+			current.WriteByte(path[i])
+		}
+	}
+	if current.Len() > 0 {
+		keys = append(keys, current.String())
+	} else if path[len(path)-1] == '.' {
+		return nil, fmt.Errorf("empty key in path %q", path)
+	}
+	return keys, nil
+}
+
+// recordFields looks up values in a record. String values holding a JSON object are decoded so nested keys in
+// a log line can be mapped. Every string is decoded once, and the result is shared by all lookups in the record.
+type recordFields struct {
+	record map[interface{}]interface{}
+	// decoded holds the decoded JSON objects by the path of their string value, or nil when the value is no JSON object.
+	decoded map[string]map[string]interface{}
+}
+
+func newRecordFields(record map[interface{}]interface{}) *recordFields {
+	fields := &recordFields{}
+	fields.reset(record)
+	return fields
+}
+
+// reset prepares the fields for the next record, reusing the memory of the previous one.
+func (f *recordFields) reset(record map[interface{}]interface{}) {
+	f.record = record
+	clear(f.decoded)
+}
+
+// lookup returns the value at the given path or false when the record does not contain it.
+func (f *recordFields) lookup(path []string) (interface{}, bool) {
+	var current interface{} = f.record
+	for idx, key := range path {
+		switch value := current.(type) {
+		case map[interface{}]interface{}:
+			next, ok := value[key]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case map[string]interface{}:
+			next, ok := value[key]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case string, []byte:
+			nested := f.decode(path[:idx], value)
+			next, ok := nested[key]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func (f *recordFields) decode(path []string, value interface{}) map[string]interface{} {
+	key := strings.Join(path, "\x00")
+	if nested, ok := f.decoded[key]; ok {
+		return nested
+	}
+	nested, _ := decodeJsonObject(value)
+	if f.decoded == nil {
+		f.decoded = map[string]map[string]interface{}{}
+	}
+	f.decoded[key] = nested
+	return nested
+}
+
+func decodeJsonObject(v interface{}) (map[string]interface{}, bool) {
+	var raw []byte
+	switch value := v.(type) {
+	case string:
+		raw = []byte(value)
+	case []byte:
+		raw = value
+	}
+	raw = []byte(strings.TrimSpace(string(raw)))
+	if len(raw) == 0 || raw[0] != '{' {
+		return nil, false
+	}
+	var nested map[string]interface{}
+	if err := json.Unmarshal(raw, &nested); err != nil {
+		return nil, false
+	}
+	return nested, true
+}
+
+func (m ColumnMapping) apply(fields *recordFields, entry FluentbitLogEntry) {
+	for _, column := range m {
+		raw, ok := fields.lookup(column.Path)
+		if !ok {
+			if column.Required {
+				entry[column.Name] = ""
+			}
+			continue
+		}
+		entry[column.Name] = convertRecordValue(raw)
+	}
+}
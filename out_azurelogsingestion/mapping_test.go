@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadColumnMapping_nothingConfigured_returnsDefault(t *testing.T) {
+	mapping, err := loadColumnMapping("", "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultColumnMapping, mapping)
+}
+
+func TestLoadColumnMapping_inlineAndFile_returnsError(t *testing.T) {
+	_, err := loadColumnMapping("log=log", "mapping.conf")
+
+	assert.Error(t, err)
+}
+
+func TestLoadColumnMapping_file_parsesLines(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mapping.conf")
+	content := "# columns for the app table\nlog=log\napp=kubernetes.labels.app\n"
+	assert.NoError(t, os.WriteFile(file, []byte(content), 0600))
+
+	mapping, err := loadColumnMapping("", file)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ColumnMapping{
+		{Name: "log", Path: []string{"log"}},
+		{Name: "app", Path: []string{"kubernetes", "labels", "app"}},
+	}, mapping)
+}
+
+func TestParseColumnMapping_invalidDefinitions_returnsError(t *testing.T) {
+	for _, spec := range []string{"log", "=log", "log=", "log=log,log=stream", "TimeGenerated=time", "a=kubernetes..labels", "a=labels['app"} {
+		_, err := parseColumnMapping(spec)
+
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestParseRecordPath_bracketKeys_keepsDots(t *testing.T) {
+	path, err := parseRecordPath("kubernetes.labels['app.kubernetes.io/name'].value")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"kubernetes", "labels", "app.kubernetes.io/name", "value"}, path)
+}
+
+func TestConvertToFluentbitLogEntry_customMapping_mapsNestedValues(t *testing.T) {
+	now := time.Now().UTC()
+	record := map[interface{}]interface{}{
+		"log": []byte("{\"level\":\"error\",\"context\":{\"user\":\"alice\"}}"),
+		"kubernetes": map[interface{}]interface{}{
+			"labels": map[interface{}]interface{}{
+				"app":                    "api",
+				"app.kubernetes.io/name": "backend",
+			},
+		},
+	}
+	mapping, err := parseColumnMapping("app=kubernetes.labels.app, name=kubernetes.labels['app.kubernetes.io/name'], level=log.level, user=log.context.user, missing=kubernetes.annotations.team")
+	assert.NoError(t, err)
+
+	entry := convertToFluentbitLogEntry(record, now, mapping)
+
+	assert.Equal(t, FluentbitLogEntry{
+		"TimeGenerated": now.Format(time.RFC3339Nano),
+		"app":           "api",
+		"name":          "backend",
+		"level":         "error",
+		"user":          "alice",
+	}, entry)
+}
+
+func TestRecordFields_lookup_decodesLogOnce(t *testing.T) {
+	fields := newRecordFields(map[interface{}]interface{}{"log": "{\"level\":\"error\",\"context\":{\"user\":\"alice\"}}", "stream": "stdout"})
+
+	level, _ := fields.lookup([]string{"log", "level"})
+	user, _ := fields.lookup([]string{"log", "context", "user"})
+	_, found := fields.lookup([]string{"stream", "level"})
+
+	assert.Equal(t, "error", level)
+	assert.Equal(t, "alice", user)
+	assert.False(t, found)
+	assert.Len(t, fields.decoded, 2)
+
+	fields.reset(map[interface{}]interface{}{"log": "{\"level\":\"info\"}"})
+	level, _ = fields.lookup([]string{"log", "level"})
+	assert.Equal(t, "info", level)
+}
+
+func TestDefaultColumnMapping_recordWithoutLog_sendsEmptyLog(t *testing.T) {
+	record := map[interface{}]interface{}{"stream": "stdout"}
+	var buf bytes.Buffer
+
+	defaultColumnMapping.Encode(&buf, newRecordFields(record), time.Date(2025, 5, 12, 12, 0, 0, 0, time.UTC))
+
+	assert.JSONEq(t, `{"TimeGenerated":"2025-05-12T12:00:00Z","log":"","stream":"stdout"}`, buf.String())
+	assert.Equal(t, "", defaultColumnMapping.Convert(record, time.Now())["log"])
+}
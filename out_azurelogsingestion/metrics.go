@@ -0,0 +1,250 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	metricsNamespace = "azurelogsingestion"
+
+	dropReasonNoRoute      = "no_route"
+	dropReasonOversized    = "oversized"
+	dropReasonRejected     = "rejected"
+	dropReasonSpoolEvicted = "spool_evicted"
+	dropReasonDrainTimeout = "drain_timeout"
+)
+
+var (
+	destinationLabels = []string{"instance", "stream", "dcr"}
+
+	metricsRegistry = prometheus.NewRegistry()
+
+	recordsConverted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_converted_total",
+		Help:      "Records converted to rows for Azure.",
+	}, destinationLabels)
+	recordsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_dropped_total",
+		Help:      "Records that are not sent, because no route matches, they do not fit in a request, the retry policy drops them, the spool is full or the drain timeout expired.",
+	}, append(destinationLabels, "reason"))
+	uploadedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes of request bodies accepted by Azure.",
+	}, destinationLabels)
+	uploadedBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploaded_batches_total",
+		Help:      "Requests accepted by Azure.",
+	}, destinationLabels)
+	uploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Duration of upload requests to Azure, including failed ones.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, destinationLabels)
+	uploadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_errors_total",
+		Help:      "Failed upload requests by HTTP status code, network errors have status none.",
+	}, append(destinationLabels, "status"))
+	uploadRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_retries_total",
+		Help:      "Retries of queued requests.",
+	}, destinationLabels)
+	flushRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "flush_retries_total",
+		Help:      "Flushes that were returned to fluent-bit to be retried.",
+	}, []string{"instance"})
+	tokenRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_requests_total",
+		Help:      "Token requests to Azure AD by result. The SDK caches tokens, so these are refreshes.",
+	}, []string{"instance", "result"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(recordsConverted, recordsDropped, uploadedBytes, uploadedBatches, uploadDuration,
+		uploadErrors, uploadRetries, flushRetries, tokenRequests)
+}
+
+// instanceMetrics records the metrics of an operator. A nil instanceMetrics records nothing.
+type instanceMetrics struct {
+	instance string
+}
+
+func newInstanceMetrics(id int) *instanceMetrics {
+	return &instanceMetrics{instance: strconv.Itoa(id)}
+}
+
+func (m *instanceMetrics) labels(destination Destination) prometheus.Labels {
+	return prometheus.Labels{"instance": m.instance, "stream": destination.StreamName, "dcr": destination.DcrImmutableId}
+}
+
+func (m *instanceMetrics) recordsConverted(destination Destination, count int) {
+	if m == nil || count == 0 {
+		return
+	}
+	recordsConverted.With(m.labels(destination)).Add(float64(count))
+}
+
+func (m *instanceMetrics) recordsDropped(destination Destination, reason string, count int) {
+	if m == nil || count == 0 {
+		return
+	}
+	labels := m.labels(destination)
+	labels["reason"] = reason
+	recordsDropped.With(labels).Add(float64(count))
+}
+
+func (m *instanceMetrics) uploaded(destination Destination, size int, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	uploadDuration.With(m.labels(destination)).Observe(duration.Seconds())
+	if err != nil {
+		labels := m.labels(destination)
+		labels["status"] = statusLabel(err)
+		uploadErrors.With(labels).Inc()
+		return
+	}
+	uploadedBytes.With(m.labels(destination)).Add(float64(size))
+	uploadedBatches.With(m.labels(destination)).Inc()
+}
+
+func (m *instanceMetrics) uploadRetried(batch Batch) {
+	if m == nil {
+		return
+	}
+	uploadRetries.With(m.labels(batch.Destination)).Inc()
+}
+
+func (m *instanceMetrics) flushRetried() {
+	if m == nil {
+		return
+	}
+	flushRetries.WithLabelValues(m.instance).Inc()
+}
+
+func (m *instanceMetrics) tokenRequested(err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	tokenRequests.WithLabelValues(m.instance, result).Inc()
+}
+
+func statusLabel(err error) string {
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		return strconv.Itoa(responseErr.StatusCode)
+	}
+	return "none"
+}
+
+// monitoringServers holds the metrics and health endpoints by listen address. Outputs that configure the same address share the endpoints.
+var monitoringServers = struct {
+	sync.Mutex
+	servers map[string]*monitoringServer
+}{servers: map[string]*monitoringServer{}}
+
+// monitoringServer is a metrics and health endpoint, done is closed once it stopped serving and released its listener.
+type monitoringServer struct {
+	server *http.Server
+	done   chan struct{}
+}
+
+// startMonitoringServer serves the metrics and health of all outputs on address, unless an earlier output already did.
+// It reports whether this call started the server.
+func startMonitoringServer(address string) (bool, error) {
+	monitoringServers.Lock()
+	defer monitoringServers.Unlock()
+	if _, ok := monitoringServers.servers[address]; ok {
+		return false, nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.Handle("/healthz", healthHandler(azureLogOperators, false))
+	mux.Handle("/readyz", healthHandler(azureLogOperators, true))
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to listen on %s", address)
+	}
+	done := make(chan struct{})
+	monitoringServers.servers[address] = &monitoringServer{server: server, done: done}
+	go func() {
+		defer close(done)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Err(err).Msgf("[azurelogsingestion] Monitoring endpoint on %s stopped", address)
+		}
+	}()
+	log.Info().Msgf("[azurelogsingestion] Serving metrics and health on %s", address)
+	return true, nil
+}
+
+// stopMonitoringServers stops all metrics and health endpoints, it is called when fluent-bit exits.
+func stopMonitoringServers(ctx context.Context) {
+	monitoringServers.Lock()
+	defer monitoringServers.Unlock()
+	for address := range monitoringServers.servers {
+		stopMonitoringServer(ctx, address)
+	}
+}
+
+// stopMonitoringServersAt stops the endpoints on the given addresses, for an output that failed to start after starting them.
+func stopMonitoringServersAt(ctx context.Context, addresses []string) {
+	monitoringServers.Lock()
+	defer monitoringServers.Unlock()
+	for _, address := range addresses {
+		stopMonitoringServer(ctx, address)
+	}
+}
+
+// stopMonitoringServer stops the endpoint on address, the caller holds the lock of monitoringServers.
+func stopMonitoringServer(ctx context.Context, address string) {
+	server, ok := monitoringServers.servers[address]
+	if !ok {
+		return
+	}
+	if err := server.server.Shutdown(ctx); err != nil {
+		log.Err(err).Msgf("[azurelogsingestion] Failed to stop monitoring endpoint on %s", address)
+	}
+	select {
+	case <-server.done:
+	case <-ctx.Done():
+	}
+	delete(monitoringServers.servers, address)
+}
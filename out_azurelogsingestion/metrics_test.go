@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+var testInstances atomic.Int64
+
+// newTestMetrics returns metrics with an instance id that no other test uses, as the collectors are global
+// and keep their values when the tests run more than once.
+func newTestMetrics() *instanceMetrics {
+	return newInstanceMetrics(9000 + int(testInstances.Add(1)))
+}
+
+func destinationMetric(vec *prometheus.CounterVec, instance string, destination Destination, extra ...string) float64 {
+	values := append([]string{instance, destination.StreamName, destination.DcrImmutableId}, extra...)
+	return testutil.ToFloat64(vec.WithLabelValues(values...))
+}
+
+func TestSendTo_upload_recordsMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	operator := newTestOperator(mockClient, "Custom-logs")
+	operator.metrics = newTestMetrics()
+	destination := operator.config.defaultDestination()
+
+	gomock.InOrder(
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, nil),
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(429, nil)),
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, errors.New("connection reset")),
+	)
+
+	assert.NoError(t, operator.SendLogsTo(destination, []byte(`[{"log":"1"}]`)))
+	assert.Error(t, operator.SendLogsTo(destination, []byte(`[{"log":"2"}]`)))
+	assert.Error(t, operator.SendLogsTo(destination, []byte(`[{"log":"3"}]`)))
+
+	assert.Equal(t, 13.0, destinationMetric(uploadedBytes, operator.metrics.instance, destination))
+	assert.Equal(t, 1.0, destinationMetric(uploadedBatches, operator.metrics.instance, destination))
+	assert.Equal(t, 1.0, destinationMetric(uploadErrors, operator.metrics.instance, destination, "429"))
+	assert.Equal(t, 1.0, destinationMetric(uploadErrors, operator.metrics.instance, destination, "none"))
+	assert.Equal(t, 1, testutil.CollectAndCount(uploadDuration.WithLabelValues(operator.metrics.instance, "Custom-logs", "dcr-1").(prometheus.Histogram)))
+}
+
+func TestBatchBuilder_batches_recordsConvertedAndDropped(t *testing.T) {
+	tenantA := Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-tenant-a"}
+	operator := &AzureOperator{
+		config: AzureConfig{RecordRoutes: []RecordRoute{
+			{Path: []string{"tenant"}, ValuePattern: "a", Destination: tenantA},
+		}},
+		converter: ColumnMapping{{Name: "log", Path: []string{"log"}}},
+		metrics:   newTestMetrics(),
+	}
+	timestamp := time.Date(2025, 5, 12, 12, 0, 0, 0, time.UTC)
+	builder := newBatchBuilder(operator, "kube.app")
+	builder.add(map[interface{}]interface{}{"tenant": "a", "log": "a1"}, timestamp)
+	builder.add(map[interface{}]interface{}{"tenant": "a", "log": "a2"}, timestamp)
+	builder.add(map[interface{}]interface{}{"tenant": "c", "log": "c1"}, timestamp)
+
+	builder.batches()
+
+	assert.Equal(t, 2.0, destinationMetric(recordsConverted, operator.metrics.instance, tenantA))
+	assert.Equal(t, 1.0, destinationMetric(recordsDropped, operator.metrics.instance, Destination{}, dropReasonNoRoute))
+}
+
+func TestSendQueue_retry_recordsMetrics(t *testing.T) {
+	metrics := newTestMetrics()
+	destination := Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-logs"}
+	queue := newSendQueue(oneMb, 0)
+	queue.retried = metrics.uploadRetried
+	attempts := 0
+	sent := make(chan struct{})
+	queue.start(1, func(batch Batch, _ int) error {
+		attempts++
+		if attempts == 1 {
+			return responseError(503, nil)
+		}
+		close(sent)
+		return nil
+	})
+	defer queue.close(context.Background(), func(Batch) {})
+
+	assert.NoError(t, queue.enqueue([]Batch{{Destination: destination, Payload: []byte(`[]`)}}))
+
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("batch was not retried")
+	}
+	assert.Equal(t, 1.0, destinationMetric(uploadRetries, metrics.instance, destination))
+}
+
+func TestInstanceMetrics_tokenRequested_countsByResult(t *testing.T) {
+	metrics := newTestMetrics()
+
+	metrics.tokenRequested(nil)
+	metrics.tokenRequested(errors.New("AADSTS700016: application not found"))
+	metrics.tokenRequested(nil)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(tokenRequests.WithLabelValues(metrics.instance, "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(tokenRequests.WithLabelValues(metrics.instance, "error")))
+}
+
+func TestAbandon_withoutSpool_countsDroppedRecords(t *testing.T) {
+	operator := &AzureOperator{metrics: newTestMetrics()}
+	destination := Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-logs"}
+
+	operator.abandon(Batch{Destination: destination, Payload: []byte(`[{"log":"1"},{"log":"2"}]`), Records: 2})
+
+	assert.Equal(t, 2.0, destinationMetric(recordsDropped, operator.metrics.instance, destination, dropReasonDrainTimeout))
+}
+
+func TestInstanceMetrics_nil_recordsNothing(t *testing.T) {
+	var metrics *instanceMetrics
+
+	assert.NotPanics(t, func() {
+		metrics.recordsConverted(Destination{}, 1)
+		metrics.recordsDropped(Destination{}, dropReasonOversized, 1)
+		metrics.uploaded(Destination{}, 1, time.Second, nil)
+		metrics.uploadRetried(Batch{})
+		metrics.flushRetried()
+		metrics.tokenRequested(nil)
+	})
+}
+
+func TestStartMetricsServer_sameAddress_servesOnce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+	defer stopMonitoringServers(context.Background())
+	metrics := newTestMetrics()
+	metrics.flushRetried()
+
+	started, err := startMonitoringServer(address)
+	assert.NoError(t, err)
+	assert.True(t, started)
+	started, err = startMonitoringServer(address)
+	assert.NoError(t, err)
+	assert.False(t, started)
+
+	response, err := http.Get("http://" + address + "/metrics")
+	assert.NoError(t, err)
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, string(body), `azurelogsingestion_flush_retries_total{instance="`+metrics.instance+`"} 1`)
+}
+
+func TestStartMetricsServer_addressInUse_returnsError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	_, err = startMonitoringServer(listener.Addr().String())
+
+	assert.ErrorContains(t, err, "failed to listen on")
+}
+
+func TestStopMonitoringServersAt_stopsOnlyGivenAddresses(t *testing.T) {
+	defer stopMonitoringServers(context.Background())
+	var addresses []string
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		addresses = append(addresses, listener.Addr().String())
+		assert.NoError(t, listener.Close())
+		started, err := startMonitoringServer(addresses[i])
+		assert.NoError(t, err)
+		assert.True(t, started)
+	}
+
+	stopMonitoringServersAt(context.Background(), addresses[:1])
+
+	listener, err := net.Listen("tcp", addresses[0])
+	assert.NoError(t, err)
+	assert.NoError(t, listener.Close())
+	_, err = startMonitoringServer(addresses[1])
+	assert.NoError(t, err)
+	monitoringServers.Lock()
+	defer monitoringServers.Unlock()
+	assert.NotContains(t, monitoringServers.servers, addresses[0])
+	assert.Contains(t, monitoringServers.servers, addresses[1])
+}
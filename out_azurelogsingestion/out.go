@@ -16,50 +16,97 @@ package main
 
 import (
 	"C"
-	"bytes"
 	"context"
-	"encoding/json"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
 	"github.com/fluent/fluent-bit-go/out_azurelogsingestion/out_azurelogsingestion/logs"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"os"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
 )
 
-var azureLogOperators []*AzureOperator
+var azureLogOperators = newOperatorRegistry()
+
+var instanceShutdown = &shutdown{}
 
 const oneMb = 1048576
 const extraBufferHundredBytes = 100 //Safety margin to avoid issues between our and Azure's size calculations.
 
-type FluentbitLogEntry struct {
-	TimeGenerated           string `json:"TimeGenerated"`
-	KubernetesPodName       string `json:"kubernetes_pod_name,omitempty"`
-	KubernetesNamespaceName string `json:"kubernetes_namespace_name,omitempty"`
-	KubernetesHost          string `json:"kubernetes_host,omitempty"`
-	KubernetesDockerId      string `json:"kubernetes_docker_id,omitempty"`
-	KubernetesContainerName string `json:"kubernetes_container_name,omitempty"`
-	Log                     string `json:"log"`
-	Stream                  string `json:"stream,omitempty"`
-}
+// FluentbitLogEntry is a single row sent to Azure, keyed by column name.
+type FluentbitLogEntry map[string]interface{}
 
 type AzureConfig struct {
-	DcrImmutableId string
-	Endpoint       string
-	StreamName     string
-	EndpointURI    string
-	LogLevel       string
+	DcrImmutableId         string
+	Endpoint               string
+	StreamName             string
+	EndpointURI            string
+	LogLevel               string
+	LogFormat              string
+	Mode                   string
+	Routes                 []Route
+	RecordRoutes           []RecordRoute
+	UploadWorkers          int
+	QueueMaxBytes          int
+	QueueMaxBatches        int
+	SpoolDir               string
+	DeadLetterDir          string
+	Compression            string
+	DrainTimeout           time.Duration
+	AuthMethod             string
+	ClientId               string
+	TenantId               string
+	TokenFile              string
+	Transport              transportConfig
+	Cloud                  string
+	AuthorityHost          string
+	Audience               string
+	MetricsListen          string
+	HealthListen           string
+	HealthFailureThreshold int
+	Tracing                tracingConfig
+	Heartbeat              heartbeatConfig
 }
 
 type AzureOperator struct {
-	config     AzureConfig
-	logsClient logs.AzureLogsClient
+	config       AzureConfig
+	converter    RecordConverter
+	credentials  *credentialProvider
+	logsClient   logs.AzureLogsClient
+	routeClients map[string]logs.AzureLogsClient
+	uploads      *uploadPool
+	queue        *sendQueue
+	spool        *spool
+	deadLetter   *deadLetterSink
+	retryPolicy  RetryPolicy
+	throttles    throttles
+	deliveries   *deliveryTracker
+	oversized    oversizedRecords
+	compress     bool
+	metrics      *instanceMetrics
+	uploadHealth *uploadHealth
+	logger       zerolog.Logger
+	heartbeat    *heartbeat
+	httpClient   *http.Client
+	closeOnce    sync.Once
+	// tracerProvider exports the spans of the operator, it is nil when tracing is disabled.
+	tracerProvider *sdktrace.TracerProvider
+	// uploadCtx is passed to every upload, so uploads that are still running when the drain timeout expires are cancelled.
+	uploadCtx       context.Context
+	cancelUploadCtx context.CancelFunc
 }
 
 //export FLBPluginRegister
@@ -70,17 +117,15 @@ func FLBPluginRegister(def unsafe.Pointer) int {
 
 //export FLBPluginInit
 func FLBPluginInit(plugin unsafe.Pointer) int {
-	operatorID := len(azureLogOperators)
-	log.Debug().Msgf("[azurelogsingestion] id = %d", operatorID)
-	output.FLBPluginSetContext(plugin, operatorID)
-	operator, err := NewAzureOperator(plugin)
+	operatorID := azureLogOperators.reserve()
+	operator, err := NewAzureOperator(plugin, operatorID)
 	if err != nil {
-		log.Err(err).Msg("failed creating azure operator")
-		output.FLBPluginUnregister(plugin)
-		os.Exit(1)
+		log.Err(err).Msg("[azurelogsingestion] Failed creating azure operator")
 		return output.FLB_ERROR
 	}
-	azureLogOperators = append(azureLogOperators, operator)
+	azureLogOperators.store(operatorID, operator)
+	log.Debug().Msgf("[azurelogsingestion] id = %d", operatorID)
+	output.FLBPluginSetContext(plugin, operatorID)
 
 	return output.FLB_OK
 }
@@ -93,14 +138,39 @@ func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
 
 //export FLBPluginExit
 func FLBPluginExit() int {
-	log.Debug().Msg("[azurelogsingestion] Exit called for unknown instance")
-	return output.FLB_OK
+	log.Debug().Msg("[azurelogsingestion] Exit called, closing all instances")
+	result := output.FLB_OK
+	for _, id := range azureLogOperators.ids() {
+		if exitInstance(id) != output.FLB_OK {
+			result = output.FLB_ERROR
+		}
+	}
+	return result
 }
 
 //export FLBPluginExitCtx
 func FLBPluginExitCtx(ctx unsafe.Pointer) int {
-	id := output.FLBPluginGetContext(ctx).(string)
-	log.Debug().Msgf("[azurelogsingestion] Exit called for id: %s", id)
+	id, ok := output.FLBPluginGetContext(ctx).(int)
+	if !ok {
+		log.Error().Msg("[azurelogsingestion] Exit called without a valid instance id in its context")
+		return output.FLB_ERROR
+	}
+	log.Debug().Msgf("[azurelogsingestion] Exit called for id: %d", id)
+	return exitInstance(id)
+}
+
+// exitInstance waits until the instance is closed. All instances are closed together when the first one exits,
+// so they share one deadline and the metrics and health endpoints are stopped once the last one exited.
+func exitInstance(id int) int {
+	ok, err := instanceShutdown.exit(azureLogOperators, id)
+	if !ok {
+		log.Warn().Msgf("[azurelogsingestion] Exit called for unknown id: %d", id)
+		return output.FLB_OK
+	}
+	if err != nil {
+		log.Err(err).Msgf("[azurelogsingestion] Failed to close instance %d", id)
+		return output.FLB_ERROR
+	}
 	return output.FLB_OK
 }
 
@@ -112,148 +182,401 @@ func FLBPluginUnregister(def unsafe.Pointer) {
 
 //export FLBPluginFlushCtx
 func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
-	id := output.FLBPluginGetContext(ctx).(int)
-	log.Debug().Msgf("[azurelogsingestion] Flush called for id: %d", id)
-	operator := azureLogOperators[id]
-	decoder := output.NewDecoder(data, int(length))
+	id, ok := output.FLBPluginGetContext(ctx).(int)
+	if !ok {
+		log.Error().Msg("[azurelogsingestion] Flush called without a valid instance id in its context, retrying")
+		return output.FLB_RETRY
+	}
+	flbTag := C.GoString(tag)
+	log.Debug().Msgf("[azurelogsingestion] Flush called for id: %d, tag: %s", id, flbTag)
+	return flushInstance(id, data, int(length), flbTag)
+}
 
-	jsonEntries, err := convertToJson(decoder)
+func flushInstance(id int, data unsafe.Pointer, length int, flbTag string) int {
+	operator, ok := azureLogOperators.get(id)
+	if !ok {
+		log.Error().Msgf("[azurelogsingestion] Flush called for unknown id: %d", id)
+		return output.FLB_ERROR
+	}
+	ctx, span := operator.tracer().Start(context.Background(), spanFlush, trace.WithAttributes(
+		attribute.Int("fluentbit.output.instance", id),
+		attribute.String("fluentbit.tag", flbTag),
+		attribute.Int("fluentbit.chunk.bytes", length),
+	))
+	logger := operator.logger.With().Str("tag", flbTag).Logger()
+	if !operator.credentials.authenticated() {
+		logger.Warn().Msg("[azurelogsingestion] Not authenticated with Azure yet, retrying flush")
+		operator.metrics.flushRetried()
+		endSpan(span, errors.New("not authenticated with Azure"))
+		return output.FLB_RETRY
+	}
+	decoder := output.NewDecoder(data, length)
+
+	chunk := newChunkID(flbTag, unsafe.Slice((*byte)(data), length))
+
+	batches, err := convertToBatches(ctx, decoder, operator, chunk, flbTag)
 	if err != nil {
+		endSpan(span, err)
 		return output.FLB_ERROR
 	}
-	err = processEntries(jsonEntries, operator)
+	err = processEntries(chunk, batches, operator)
+	endSpan(span, err)
 	if err != nil {
-		log.Err(err).Msg("[azurelogsingestion] Failed to send logs to azure")
+		logger.Err(err).Msg("[azurelogsingestion] Failed to send logs to azure")
+		operator.metrics.flushRetried()
 		return output.FLB_RETRY
 	}
 
 	return output.FLB_OK
 }
 
-func processEntries(jsonEntries [][]byte, operator *AzureOperator) error {
-	for _, jsonEntry := range jsonEntries {
-		err := operator.SendLogs(jsonEntry)
+// processEntries uploads the batches of a chunk. Batches that were accepted during an earlier attempt
+// of the same chunk are skipped, so a retried chunk does not result in duplicate logs.
+func processEntries(chunk chunkID, batches []Batch, operator *AzureOperator) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	if operator.queue != nil {
+		err := operator.queue.enqueue(batches)
 		if err != nil {
+			releaseBatches(batches)
+		}
+		return err
+	}
+	defer releaseBatches(batches)
+	if operator.deliveries == nil {
+		return operator.uploads.upload(batches, func(batch Batch) error {
+			return operator.deliver(batch, true)
+		})
+	}
+	pending := operator.deliveries.pending(chunk, batches)
+	if skipped := len(batches) - len(pending); skipped > 0 {
+		operator.logger.Info().Msgf("[azurelogsingestion] Skipping %d batches that were already delivered in a previous attempt", skipped)
+	}
+	// The first attempt of a chunk is retried by fluent-bit, whose default Retry_Limit allows a single retry.
+	// A retried chunk is the last chance to deliver it, so its failed batches are spooled.
+	retried := operator.deliveries.attempt(chunk) > 0
+	err := operator.uploads.upload(pending, func(batch Batch) error {
+		if err := operator.deliver(batch, retried); err != nil {
 			return err
 		}
+		operator.deliveries.markDelivered(chunk, batch)
+		return nil
+	})
+	if err == nil {
+		operator.deliveries.complete(chunk)
 	}
-	return nil
+	return err
 }
 
-func NewAzureOperator(plugin unsafe.Pointer) (*AzureOperator, error) {
+func NewAzureOperator(plugin unsafe.Pointer, id int) (*AzureOperator, error) {
 	dcrImmutableId := output.FLBPluginConfigKey(plugin, "dcrImmutableId")
 	endpoint := output.FLBPluginConfigKey(plugin, "endpoint")
 	streamName := output.FLBPluginConfigKey(plugin, "streamName")
-	logLevel := output.FLBPluginConfigKey(plugin, "logLevel")
-	config := AzureConfig{
-		DcrImmutableId: dcrImmutableId,
-		Endpoint:       endpoint,
-		StreamName:     streamName,
-		LogLevel:       logLevel,
+	loggerConfig, err := parseLoggerConfig(func(key string) string {
+		return output.FLBPluginConfigKey(plugin, key)
+	})
+	if err != nil {
+		return nil, err
 	}
-	err := setLogLevel(logLevel)
+	logger := newInstanceLogger(loggerConfig, id, streamName)
+	mode := output.FLBPluginConfigKey(plugin, "mode")
+	converter, err := newRecordConverter(mode, output.FLBPluginConfigKey(plugin, "mapping"), output.FLBPluginConfigKey(plugin, "mappingFile"))
 	if err != nil {
 		return nil, err
 	}
-
-	log.Warn().Msgf("[azurelogsingestion] Config: %v", config)
-	return &AzureOperator{
-		config:     config,
-		logsClient: constructClient(config),
-	}, nil
-}
-
-func setLogLevel(logLevel string) error {
-	if logLevel == "" {
-		log.Warn().Msg("[azurelogsingestion] No log level configured, defaulting to warn")
-		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	routes, err := parseRoutes(output.FLBPluginConfigKey(plugin, "routes"))
+	if err != nil {
+		return nil, err
 	}
-	level, err := zerolog.ParseLevel(logLevel)
+	recordRoutes, err := parseRecordRoutes(output.FLBPluginConfigKey(plugin, "recordRoutes"))
 	if err != nil {
-		log.Err(errors.Wrap(err, "failed to parse log level"))
-		return err
+		return nil, err
 	}
-	zerolog.SetGlobalLevel(level)
-	return nil
-}
-
-func constructClient(config AzureConfig) logs.AzureLogsClient {
-	var cred, err = azidentity.NewDefaultAzureCredential(nil)
+	if err := validateDestinations(Destination{Endpoint: endpoint, DcrImmutableId: dcrImmutableId, StreamName: streamName}, routes, recordRoutes); err != nil {
+		return nil, err
+	}
+	workers, err := parsePositiveInt(output.FLBPluginConfigKey(plugin, "uploadWorkers"), defaultWorkers)
 	if err != nil {
-		panic(err)
+		return nil, errors.Wrap(err, "invalid value for UploadWorkers")
 	}
-
-	scope := "https://monitor.azure.com/.default"
-	_, err = cred.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{scope}})
+	queueMaxBytes, err := parseSize(output.FLBPluginConfigKey(plugin, "queueMaxBytes"))
 	if err != nil {
-		panic(err)
+		return nil, errors.Wrap(err, "invalid value for QueueMaxBytes")
 	}
-	log.Debug().Msgf("[azurelogsingestion] Successfully retrieved token for client")
-	client, err := azlogs.NewClient(config.Endpoint, cred, nil)
-	clientId := os.Getenv("AZURE_CLIENT_ID")
+	queueMaxBatches, err := parsePositiveInt(output.FLBPluginConfigKey(plugin, "queueMaxBatches"), defaultQueueMaxBatches)
 	if err != nil {
-		log.Debug().Msgf("[azurelogsingestion] Successfully retrieve token for client %s, and scope %s", clientId, scope)
-		panic(err)
+		return nil, errors.Wrap(err, "invalid value for QueueMaxBatches")
 	}
-	return client
-}
-
-func convertToJson(dec *output.FLBDecoder) ([][]byte, error) {
-	var entries []FluentbitLogEntry
-	for {
-		ret, ts, record := output.GetRecord(dec)
-		if ret != 0 {
-			break
+	compression := output.FLBPluginConfigKey(plugin, "compression")
+	compress, err := parseCompression(compression)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid value for Compression")
+	}
+	deadLetterDir := output.FLBPluginConfigKey(plugin, "deadLetterDir")
+	var deadLetter *deadLetterSink
+	if deadLetterDir != "" {
+		maxFileSize, err := parseSize(output.FLBPluginConfigKey(plugin, "deadLetterMaxFileSize"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid value for DeadLetterMaxFileSize")
+		}
+		retention, err := parseDuration(output.FLBPluginConfigKey(plugin, "deadLetterRetention"), defaultDeadLetterRetention)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid value for DeadLetterRetention")
+		}
+		deadLetter, err = newDeadLetterSink(deadLetterDir, maxFileSize, retention)
+		if err != nil {
+			return nil, err
 		}
-		fluentbitEntry := convertToFluentbitLogEntry(record, getTimestampOrNow(ts))
-		entries = append(entries, fluentbitEntry)
+		deadLetter.logger = logger
 	}
-	jsonEntries, err := convertFluentbitEntriesToJson(entries)
+	oversized, err := newOversizedRecords(output.FLBPluginConfigKey(plugin, "oversizedRecords"), deadLetter)
 	if err != nil {
 		return nil, err
 	}
-	return jsonEntries, nil
-}
-
-var startBytes = []byte("[")
-var endBytes = []byte("]")
-var seperatorBytes = []byte(",")
+	oversized.logger = logger
+	retryPolicy, err := parseRetryPolicy(output.FLBPluginConfigKey(plugin, "retryPolicy"), deadLetter != nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid value for RetryPolicy")
+	}
+	spoolDir := output.FLBPluginConfigKey(plugin, "spoolDir")
+	var batchSpool *spool
+	spoolReplayInterval := defaultSpoolReplayInterval
+	if spoolDir != "" {
+		spoolMaxBytes, err := parseSize(output.FLBPluginConfigKey(plugin, "spoolMaxBytes"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid value for SpoolMaxBytes")
+		}
+		batchSpool, err = newSpool(spoolDir, spoolMaxBytes, output.FLBPluginConfigKey(plugin, "spoolEviction"))
+		if err != nil {
+			return nil, err
+		}
+		batchSpool.logger = logger
+		spoolReplayInterval, err = parseDuration(output.FLBPluginConfigKey(plugin, "spoolReplayInterval"), defaultSpoolReplayInterval)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid value for SpoolReplayInterval")
+		}
+	}
+	drainTimeout, err := parseDuration(output.FLBPluginConfigKey(plugin, "drainTimeout"), defaultDrainTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid value for DrainTimeout")
+	}
+	auth, err := parseAuthConfig(func(key string) string {
+		return output.FLBPluginConfigKey(plugin, key)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid authentication configuration")
+	}
+	cloudName := output.FLBPluginConfigKey(plugin, "cloud")
+	authorityHost := output.FLBPluginConfigKey(plugin, "authorityHost")
+	audience := output.FLBPluginConfigKey(plugin, "audience")
+	cloudConfig, err := parseCloud(cloudName, authorityHost, audience)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid value for Cloud")
+	}
+	transport, err := parseTransportConfig(func(key string) string {
+		return output.FLBPluginConfigKey(plugin, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	heartbeat, err := parseHeartbeatConfig(func(key string) string {
+		return output.FLBPluginConfigKey(plugin, key)
+	}, Destination{Endpoint: endpoint, DcrImmutableId: dcrImmutableId, StreamName: streamName})
+	if err != nil {
+		return nil, err
+	}
+	metricsListen := output.FLBPluginConfigKey(plugin, "metricsListen")
+	healthListen := output.FLBPluginConfigKey(plugin, "healthListen")
+	tracing, err := parseTracingConfig(func(key string) string {
+		return output.FLBPluginConfigKey(plugin, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	healthFailureThreshold, err := parsePositiveInt(output.FLBPluginConfigKey(plugin, "healthFailureThreshold"), defaultHealthFailureThreshold)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid value for HealthFailureThreshold")
+	}
+	config := AzureConfig{
+		DcrImmutableId:         dcrImmutableId,
+		Endpoint:               endpoint,
+		StreamName:             streamName,
+		LogLevel:               loggerConfig.Level.String(),
+		LogFormat:              loggerConfig.Format,
+		Mode:                   mode,
+		Routes:                 routes,
+		RecordRoutes:           recordRoutes,
+		UploadWorkers:          workers,
+		QueueMaxBytes:          queueMaxBytes,
+		QueueMaxBatches:        queueMaxBatches,
+		SpoolDir:               spoolDir,
+		DeadLetterDir:          deadLetterDir,
+		Compression:            compression,
+		DrainTimeout:           drainTimeout,
+		AuthMethod:             auth.Method,
+		ClientId:               auth.ClientId,
+		TenantId:               auth.TenantId,
+		TokenFile:              auth.TokenFile,
+		Transport:              transport,
+		Cloud:                  cloudName,
+		AuthorityHost:          authorityHost,
+		Audience:               audience,
+		MetricsListen:          metricsListen,
+		HealthListen:           healthListen,
+		HealthFailureThreshold: healthFailureThreshold,
+		Tracing:                tracing,
+		Heartbeat:              heartbeat,
+	}
 
-func convertFluentbitEntriesToJson(entries []FluentbitLogEntry) ([][]byte, error) {
-	if len(entries) == 0 {
-		return nil, nil
+	logger.Warn().Msgf("[azurelogsingestion] Config: %v", config)
+	httpClient := newHTTPClient(transport)
+	clientOptions := azcore.ClientOptions{Transport: httpClient, Cloud: cloudConfig}
+	credentials := newCredentialProvider(func() (azcore.TokenCredential, error) {
+		return newCredential(auth, clientOptions)
+	}, tokenScope(cloudConfig))
+	metrics := newInstanceMetrics(id)
+	credentials.requested = metrics.tokenRequested
+	if batchSpool != nil {
+		batchSpool.evicted = func(batch Batch) {
+			metrics.recordsDropped(batch.Destination, dropReasonSpoolEvicted, batch.Records)
+		}
 	}
-	var jsonValues [][]byte
-	buf := bytes.NewBuffer([]byte{})
-	buf.Grow(oneMb)
-	for _, entry := range entries {
-		jsonValue, err := json.Marshal(entry)
+	credentials.logger = logger
+	logsClient, err := constructClient(config.Endpoint, credentials, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	routeClients := map[string]logs.AzureLogsClient{}
+	for _, endpoint := range config.routeEndpoints() {
+		routeClients[endpoint], err = constructClient(endpoint, credentials, clientOptions)
 		if err != nil {
-			log.Err(err).Msg("[azurelogsingestion] Failed to marshal fluentbit entry to json")
+			return nil, err
+		}
+	}
+	operator := &AzureOperator{
+		config:       config,
+		converter:    converter,
+		credentials:  credentials,
+		logsClient:   logsClient,
+		routeClients: routeClients,
+		uploads:      newUploadPool(workers),
+		spool:        batchSpool,
+		deadLetter:   deadLetter,
+		retryPolicy:  retryPolicy,
+		deliveries:   newDeliveryTracker(defaultTrackedChunks, defaultTrackedChunkTTL),
+		oversized:    oversized,
+		compress:     compress,
+		metrics:      metrics,
+		logger:       logger,
+		uploadHealth: newUploadHealth(healthFailureThreshold),
+		httpClient:   httpClient,
+	}
+	operator.tracerProvider, err = newTracerProvider(tracing, id)
+	if err != nil {
+		return nil, err
+	}
+	var started []string
+	for _, address := range []string{metricsListen, healthListen} {
+		if address == "" {
+			continue
 		}
-		if buf.Len() != 0 && buf.Len()+len(jsonValue)+len(endBytes)+extraBufferHundredBytes > oneMb {
-			buf.Write(endBytes)
-			jsonValuesBuff := make([]byte, buf.Len())
-			copy(jsonValuesBuff, buf.Bytes()) //We make a copy here, if we do not do this the next iteration will overwrite what we just inputted here
-			jsonValues = append(jsonValues, jsonValuesBuff)
-			buf.Reset()
+		ok, err := startMonitoringServer(address)
+		if err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), defaultDrainTimeout)
+			defer cancel()
+			stopMonitoringServersAt(ctx, started)
+			if err := operator.shutdownTracing(ctx); err != nil {
+				operator.logger.Err(err).Msg("[azurelogsingestion] Failed to export the remaining spans")
+			}
+			return nil, err
 		}
-		if buf.Len() == 0 {
-			//First entry, we start the array
-			buf.Write(startBytes)
-		} else {
-			//Not the first entry, we add a seperator
-			buf.Write(seperatorBytes)
+		if ok {
+			started = append(started, address)
 		}
-		buf.Write(jsonValue)
 	}
-	if buf.Len() > 0 {
-		buf.Write(endBytes)
-		jsonValues = append(jsonValues, buf.Bytes())
+	operator.uploadCtx, operator.cancelUploadCtx = context.WithCancel(context.Background())
+	credentials.start()
+	if queueMaxBytes > 0 {
+		operator.queue = newSendQueue(queueMaxBytes, queueMaxBatches)
+		operator.queue.retried = metrics.uploadRetried
+		operator.queue.logger = logger
+		operator.queue.start(workers, operator.deliverQueued)
+	}
+	if batchSpool != nil {
+		batchSpool.startReplay(spoolReplayInterval, operator.upload)
+	}
+	if heartbeat.Destination.StreamName != "" {
+		operator.heartbeat = newHeartbeat(heartbeat, id)
+		operator.heartbeat.start(operator)
 	}
-	return jsonValues, nil
+	return operator, nil
 }
 
+func parsePositiveInt(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if parsed < 1 {
+		return 0, fmt.Errorf("expected a positive number, got %d", parsed)
+	}
+	return parsed, nil
+}
+
+// parseSize parses a number of bytes with an optional K, KB, M, MB, G or GB suffix.
+func parseSize(value string) (int, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := 1
+	for suffix, factor := range map[string]int{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if strings.HasSuffix(value, suffix+"B") {
+			value, multiplier = strings.TrimSuffix(value, suffix+"B"), factor
+		} else if strings.HasSuffix(value, suffix) {
+			value, multiplier = strings.TrimSuffix(value, suffix), factor
+		}
+	}
+	parsed, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	if parsed < 0 {
+		return 0, fmt.Errorf("expected a positive size, got %d", parsed)
+	}
+	return parsed * multiplier, nil
+}
+
+func parseDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if parsed <= 0 {
+		return 0, fmt.Errorf("expected a positive duration, got %s", value)
+	}
+	return parsed, nil
+}
+
+func constructClient(endpoint string, cred azcore.TokenCredential, clientOptions azcore.ClientOptions) (logs.AzureLogsClient, error) {
+	client, err := azlogs.NewClient(endpoint, cred, &azlogs.ClientOptions{ClientOptions: clientOptions})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create logs client for endpoint %s", endpoint)
+	}
+	return client, nil
+}
+
+var startBytes = []byte("[")
+var endBytes = []byte("]")
+var seperatorBytes = []byte(",")
+
 func getTimestampOrNow(ts interface{}) time.Time {
 	switch t := ts.(type) {
 	case output.FLBTime:
@@ -266,68 +589,178 @@ func getTimestampOrNow(ts interface{}) time.Time {
 	}
 }
 
-func convertToFluentbitLogEntry(record map[interface{}]interface{}, timestamp time.Time) FluentbitLogEntry {
-	fluentBitLog := FluentbitLogEntry{TimeGenerated: timestamp.UTC().Format(time.RFC3339Nano)}
-
-	for k, v := range record {
-		key := k.(string)
-		switch key {
-		case "kubernetes":
-			convertKubernetesProperties(v.(map[interface{}]interface{}), &fluentBitLog)
-		case "log":
-			fluentBitLog.Log = convertSafely(v)
-		case "stream":
-			fluentBitLog.Stream = convertSafely(v)
-		case "_p":
-			// Ignore
-		case "time":
-			// Ignore as we already processed it
-		default:
-			log.Debug().Msgf("[azurelogsingestion] Unknown record key: %s", key)
-		}
-	}
+func convertToFluentbitLogEntry(record map[interface{}]interface{}, timestamp time.Time, mapping ColumnMapping) FluentbitLogEntry {
+	fluentBitLog := FluentbitLogEntry{timeGeneratedColumn: timestamp.UTC().Format(time.RFC3339Nano)}
+	mapping.apply(newRecordFields(record), fluentBitLog)
 	return fluentBitLog
 }
 
-func convertKubernetesProperties(m map[interface{}]interface{}, f *FluentbitLogEntry) {
-	for k, v := range m {
-		keyAsString := k.(string)
-		switch keyAsString {
-		case "pod_name":
-			f.KubernetesPodName = convertSafely(v)
-		case "namespace_name":
-			f.KubernetesNamespaceName = convertSafely(v)
-		case "host":
-			f.KubernetesHost = convertSafely(v)
-		case "docker_id":
-			f.KubernetesDockerId = convertSafely(v)
-		case "container_name":
-			f.KubernetesContainerName = convertSafely(v)
-		default:
-			log.Debug().Msgf("[azurelogsingestion] Unknown kubernetes record key: %s", keyAsString)
+func (a *AzureOperator) SendLogs(value []byte) error {
+	return a.SendLogsTo(a.config.defaultDestination(), value)
+}
+
+func (a *AzureOperator) SendLogsTo(destination Destination, value []byte) error {
+	return a.sendTo(a.uploadContext(), destination, value, nil)
+}
+
+// sendTo uploads body to the destination. The attributes are added to the upload span.
+func (a *AzureOperator) sendTo(ctx context.Context, destination Destination, body []byte, options *azlogs.UploadOptions, attributes ...attribute.KeyValue) error {
+	client, ok := a.clientFor(destination.Endpoint)
+	if !ok {
+		return rejectedError{err: errors.Errorf("endpoint %s of stream %s is not configured for this output", destination.Endpoint, destination.StreamName)}
+	}
+	ctx, span := a.tracer().Start(ctx, spanUpload, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("azure.stream_name", destination.StreamName),
+		attribute.String("azure.dcr_immutable_id", destination.DcrImmutableId),
+		attribute.String("azure.endpoint", destination.Endpoint),
+		attribute.Int("azurelogsingestion.batch.bytes", len(body)),
+	), trace.WithAttributes(attributes...))
+	var response *http.Response
+	start := time.Now()
+	_, err := client.Upload(policy.WithCaptureResponse(ctx, &response),
+		destination.DcrImmutableId,
+		destination.StreamName,
+		body,
+		options)
+	a.metrics.uploaded(destination, len(body), time.Since(start), err)
+	a.uploadHealth.uploaded(time.Now(), len(body), err)
+	span.SetAttributes(responseAttributes(response, err)...)
+	endSpan(span, err)
+	return err
+}
+
+// send uploads the batch, gzipped when compression is enabled. The upload span is a child of the span of the flush that created the batch.
+func (a *AzureOperator) send(batch Batch) error {
+	ctx := trace.ContextWithSpanContext(a.uploadContext(), batch.Trace)
+	body := batch.Payload
+	var options *azlogs.UploadOptions
+	if a.compress {
+		compressed, err := gzipPayload(batch.Payload)
+		if err != nil {
+			return err
 		}
+		body = compressed
+		options = &azlogs.UploadOptions{ContentEncoding: to.Ptr(compressionGzip)}
 	}
+	if err := a.sendTo(ctx, batch.Destination, body, options, attribute.Int("azurelogsingestion.records", batch.Records)); err != nil {
+		return err
+	}
+	a.uploadHealth.recordsUploaded(batch.Records)
+	return nil
 }
 
-func convertSafely(v interface{}) string {
-	switch res := v.(type) {
-	case string:
-		return res
-	case []byte:
-		return string(res)
+// upload sends the batch unless Azure asked us to back off from its destination and applies the retry policy to a failed upload.
+// Batches that the policy drops are logged, counted as dropped and reported as sent.
+func (a *AzureOperator) upload(batch Batch) error {
+	throttle := a.throttles.get(batch.Destination)
+	if err := throttle.check(time.Now()); err != nil {
+		return err
+	}
+	err := a.send(batch)
+	if err == nil {
+		return nil
+	}
+	if isRejected(err) {
+		if a.deadLetter == nil {
+			return err
+		}
+		a.logger.Err(err).Msgf("[azurelogsingestion] Cannot send batch for stream %s, writing it to the dead-letter directory", batch.Destination.StreamName)
+		return a.writeDeadLetter(batch, err)
+	}
+	if wait := retryAfter(err, time.Now()); wait > 0 {
+		throttle.extend(time.Now().Add(wait))
+	}
+	switch a.retryPolicy.classify(err) {
+	case actionSplit:
+		return a.uploadSplit(batch, err)
+	case actionDrop:
+		a.logger.Err(err).Msgf("[azurelogsingestion] Azure rejected batch for stream %s permanently, dropping it", batch.Destination.StreamName)
+		a.metrics.recordsDropped(batch.Destination, dropReasonRejected, batch.Records)
+		return nil
+	case actionDeadLetter:
+		a.logger.Err(err).Msgf("[azurelogsingestion] Azure rejected batch for stream %s permanently, writing it to the dead-letter directory", batch.Destination.StreamName)
+		return a.writeDeadLetter(batch, err)
 	default:
-		log.Debug().Msgf("[azurelogsingestion] Failed to convert value: %v", v)
-		return ""
+		return err
 	}
 }
 
-func (a *AzureOperator) SendLogs(value []byte) error {
-	_, err := a.logsClient.Upload(context.Background(),
-		a.config.DcrImmutableId,
-		a.config.StreamName,
-		value,
-		nil)
-	return err
+// writeDeadLetter writes a batch that cannot be delivered to the dead-letter directory.
+func (a *AzureOperator) writeDeadLetter(batch Batch, uploadErr error) error {
+	if err := a.deadLetter.write(batch, uploadErr); err != nil {
+		return rejectedError{err: errors.Wrapf(err, "failed to dead-letter batch after upload error %v", uploadErr)}
+	}
+	return nil
+}
+
+// uploadSplit uploads the halves of a batch that Azure rejected as too large. When one of the halves fails,
+// the batch is retried as a whole. A batch with a single row cannot be split, it is dead-lettered when a
+// dead-letter directory is configured and dropped otherwise.
+func (a *AzureOperator) uploadSplit(batch Batch, uploadErr error) error {
+	halves, err := splitBatch(batch)
+	if err != nil {
+		return rejectedError{err: errors.Wrapf(err, "failed to split batch after upload error %v", uploadErr)}
+	}
+	if len(halves) == 0 {
+		if a.deadLetter == nil {
+			a.logger.Err(uploadErr).Msgf("[azurelogsingestion] Azure rejected a single record for stream %s as too large, dropping it", batch.Destination.StreamName)
+			a.metrics.recordsDropped(batch.Destination, dropReasonRejected, batch.Records)
+			return nil
+		}
+		a.logger.Err(uploadErr).Msgf("[azurelogsingestion] Azure rejected a single record for stream %s as too large, writing it to the dead-letter directory", batch.Destination.StreamName)
+		return a.writeDeadLetter(batch, uploadErr)
+	}
+	defer releaseBatches(halves)
+	a.logger.Warn().Msgf("[azurelogsingestion] Azure rejected a batch of %d records for stream %s as too large, sending it in %d parts", batch.Records, batch.Destination.StreamName, len(halves))
+	for _, half := range halves {
+		if err := a.upload(half); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver uploads the batch. When the upload fails on the last attempt and a spool is configured, the batch is stored
+// in the spool, unless Azure throttled it. Earlier attempts are retried from memory, so a short outage does not send
+// every batch to disk. Without a spool, a batch that was rejected permanently is dropped, so it does not block the
+// batches behind it.
+func (a *AzureOperator) deliver(batch Batch, lastAttempt bool) error {
+	err := a.upload(batch)
+	if err == nil {
+		return nil
+	}
+	rejected := isRejected(err)
+	if a.spool == nil {
+		if !rejected {
+			return err
+		}
+		a.logger.Err(err).Msgf("[azurelogsingestion] Dropping batch for stream %s that Azure rejected permanently", batch.Destination.StreamName)
+		a.metrics.recordsDropped(batch.Destination, dropReasonRejected, batch.Records)
+		return nil
+	}
+	if !rejected && (!lastAttempt || isThrottled(err)) {
+		return err
+	}
+	a.logger.Err(err).Msg("[azurelogsingestion] Failed to send logs to azure, storing them in the spool")
+	if spoolErr := a.spool.store(batch); spoolErr != nil {
+		return errors.Wrapf(spoolErr, "failed to spool batch after upload error %v", err)
+	}
+	return nil
+}
+
+// deliverQueued delivers a batch of the send queue, which is spooled once its retries reached the longest backoff.
+func (a *AzureOperator) deliverQueued(batch Batch, attempt int) error {
+	return a.deliver(batch, retryBackoff(attempt) >= maxRetryBackoff)
+}
+
+// clientFor returns the client for the endpoint of a destination. It returns false for an endpoint that is not
+// configured for the output, such as the endpoint of a spooled batch whose route was removed since.
+func (a *AzureOperator) clientFor(endpoint string) (logs.AzureLogsClient, bool) {
+	if endpoint == "" || endpoint == a.config.Endpoint {
+		return a.logsClient, true
+	}
+	client, ok := a.routeClients[endpoint]
+	return client, ok
 }
 
 func main() {
@@ -12,7 +12,7 @@ import (
 )
 
 func TestProcessEntries_nil_noError(t *testing.T) {
-	err := processEntries(nil, nil)
+	err := processEntries(chunkID{}, nil, nil)
 
 	assert.NoError(t, err)
 }
@@ -20,52 +20,74 @@ func TestProcessEntries_nil_noError(t *testing.T) {
 func TestConvertToFluentbitLogEntry_doesNotUnwrapLogEntry(t *testing.T) {
 	now := time.Now().UTC()
 	log := createSimpleLog(now)
-	entry := convertToFluentbitLogEntry(log, now)
+	entry := convertToFluentbitLogEntry(log, now, defaultColumnMapping)
 
-	assert.Equal(t, now.Format(time.RFC3339Nano), entry.TimeGenerated)
-	assert.Equal(t, "stdout", entry.Stream)
-	assert.Equal(t, "{\"level\":\"debug\",\"message\":\"[azurelogsingestion] id = 0\"}", entry.Log)
+	assert.Equal(t, now.Format(time.RFC3339Nano), entry["TimeGenerated"])
+	assert.Equal(t, "stdout", entry["stream"])
+	assert.Equal(t, "{\"level\":\"debug\",\"message\":\"[azurelogsingestion] id = 0\"}", entry["log"])
 }
 
 func TestConvertToFluentbitLogEntry_KubernetesEntries_unwrapsThem(t *testing.T) {
 	now := time.Now().UTC()
 	log := createLogWithKubernetesEntries(now)
-	entry := convertToFluentbitLogEntry(log, now)
-
-	assert.Equal(t, now.Format(time.RFC3339Nano), entry.TimeGenerated)
-	assert.Equal(t, "{\"level\":\"debug\",\"message\":\"[azurelogsingestion] id = 0\"}", entry.Log)
-	assert.Equal(t, "container_name", entry.KubernetesContainerName)
-	assert.Equal(t, "pod_name", entry.KubernetesPodName)
-	assert.Equal(t, "host", entry.KubernetesHost)
-	assert.Equal(t, "docker_id", entry.KubernetesDockerId)
-	assert.Equal(t, "namespace_name", entry.KubernetesNamespaceName)
+	entry := convertToFluentbitLogEntry(log, now, defaultColumnMapping)
+
+	assert.Equal(t, now.Format(time.RFC3339Nano), entry["TimeGenerated"])
+	assert.Equal(t, "{\"level\":\"debug\",\"message\":\"[azurelogsingestion] id = 0\"}", entry["log"])
+	assert.Equal(t, "container_name", entry["kubernetes_container_name"])
+	assert.Equal(t, "pod_name", entry["kubernetes_pod_name"])
+	assert.Equal(t, "host", entry["kubernetes_host"])
+	assert.Equal(t, "docker_id", entry["kubernetes_docker_id"])
+	assert.Equal(t, "namespace_name", entry["kubernetes_namespace_name"])
 }
 
 func TestConvertToFluentbitLogEntry_handlesByteArrays(t *testing.T) {
 	now := time.Now().UTC()
 	log := createLogWithByteArrayValues(now)
-	entry := convertToFluentbitLogEntry(log, now)
+	entry := convertToFluentbitLogEntry(log, now, defaultColumnMapping)
+
+	assert.Equal(t, now.Format(time.RFC3339Nano), entry["TimeGenerated"])
+	assert.Equal(t, "{\"level\":\"debug\",\"message\":\"[azurelogsingestion] id = 0\"}", entry["log"])
+	assert.Equal(t, "stdout", entry["stream"])
+}
 
-	assert.Equal(t, now.Format(time.RFC3339Nano), entry.TimeGenerated)
-	assert.Equal(t, "{\"level\":\"debug\",\"message\":\"[azurelogsingestion] id = 0\"}", entry.Log)
-	assert.Equal(t, "stdout", entry.Stream)
+// buildPayloads encodes the entries with a batchBuilder that passes every field through, so the payloads decode to the same entries.
+func buildPayloads(operator *AzureOperator, entries []FluentbitLogEntry) [][]byte {
+	if operator.converter == nil {
+		operator.converter = passthroughConverter{}
+	}
+	operator.config.DcrImmutableId, operator.config.StreamName = "dcr-1", "Custom-logs"
+	builder := newBatchBuilder(operator, "kube.app")
+	for _, entry := range entries {
+		record := map[interface{}]interface{}{}
+		for key, value := range entry {
+			if key != timeGeneratedColumn {
+				record[key] = value
+			}
+		}
+		timestamp, _ := time.Parse(time.RFC3339Nano, entry[timeGeneratedColumn].(string))
+		builder.add(record, timestamp)
+	}
+	var payloads [][]byte
+	for _, batch := range builder.batches() {
+		payloads = append(payloads, batch.Payload)
+	}
+	return payloads
 }
 
-func TestConvertFluentbitEntriesToJson_emptyList_returnsEmptyList(t *testing.T) {
-	entry, err := convertFluentbitEntriesToJson([]FluentbitLogEntry{})
+func TestBatchBuilder_noRecords_returnsNoBatches(t *testing.T) {
+	payloads := buildPayloads(&AzureOperator{}, []FluentbitLogEntry{})
 
-	assert.NoError(t, err)
-	assert.Len(t, entry, 0)
+	assert.Len(t, payloads, 0)
 }
 
-func TestConvertFluentbitEntriesToJson_returnsJsonResult(t *testing.T) {
+func TestBatchBuilder_records_returnsJsonResult(t *testing.T) {
 	log := generateDummyFluentbitLogEntry()
 	logs := []FluentbitLogEntry{log, log}
-	entry, err := convertFluentbitEntriesToJson(logs)
+	payloads := buildPayloads(&AzureOperator{}, logs)
 
-	assert.NoError(t, err)
-	assert.Len(t, entry, 1)
-	reversed := reverseEntries(t, entry)
+	assert.Len(t, payloads, 1)
+	reversed := reverseEntries(t, payloads)
 	assert.Equal(t, logs, reversed)
 }
 
@@ -80,35 +102,33 @@ func reverseEntries(t *testing.T, entries [][]byte) []FluentbitLogEntry {
 	return resultEntries
 }
 
-func TestConvertFluentbitEntriesToJson_normalEntriesLargerThan1Megabyte_splitsUpResult(t *testing.T) {
+func TestBatchBuilder_normalEntriesLargerThan1Megabyte_splitsUpResult(t *testing.T) {
 	var entriesLargerOneMb []FluentbitLogEntry
 	for idx := range 2000 {
 		log := generateDummyFluentbitLogEntry()
-		log.Log = strconv.Itoa(idx) + log.Log
+		log["log"] = strconv.Itoa(idx) + log["log"].(string)
 		entriesLargerOneMb = append(entriesLargerOneMb, log)
 	}
-	entries, err := convertFluentbitEntriesToJson(entriesLargerOneMb)
+	payloads := buildPayloads(&AzureOperator{}, entriesLargerOneMb)
 
-	assert.NoError(t, err)
-	assert.Len(t, entries, 2)
+	assert.Len(t, payloads, 2)
 
-	resultEntries := reverseEntries(t, entries)
+	resultEntries := reverseEntries(t, payloads)
 	//Make sure that when we reverse it's the same
 	assert.Len(t, resultEntries, len(entriesLargerOneMb))
 	assert.Equal(t, entriesLargerOneMb, resultEntries)
 }
 
-func TestConvertFluentbitEntriesToJson_bigEntriesLargerThan1Megabyte_splitsUpResult(t *testing.T) {
+func TestBatchBuilder_bigEntriesLargerThan1Megabyte_splitsUpResult(t *testing.T) {
 	longLog := "[2025-05-12 12:12:27,166] {kubernetes_executor.py:380} DEBUG - self.running: {TaskInstanceKey(dag_id='azurepython-secrets-fail', task_id='secrets-keyvault-parameter-does-not-exist', run_id='scheduled__2025-05-11T00:00:00+00:00', try_number=1, map_index=-1), TaskInstanceKey(dag_id='azurepython-secrets-fail', task_id='secrets-client-id-not-exists', run_id='scheduled__2025-05-11T00:00:00+00:00', try_number=1, map_index=-1), TaskInstanceKey(dag_id='azurepython-secrets-fail', task_id='secrets-client-id-no-identity-credential', run_id='scheduled__2025-05-11T00:00:00+00:00', try_number=1, map_index=-1), TaskInstanceKey(dag_id='azurepython-secrets-fail', task_id='secrets-no-client-id', run_id='scheduled__2025-05-11T00:00:00+00:00', try_number=1, map_index=-1), TaskInstanceKey(dag_id='azurepython-secrets-fail', task_id='secrets-client-id-no-keyvault-access', run_id='scheduled__2025-05-11T00:00:00+00:00', try_number=1, map_index=-1)}"
 	longLogEntry := generateDummyFluentbitLogEntryWithLog(longLog)
 	var entriesLargerOneMb []FluentbitLogEntry
 	for range 900 {
 		entriesLargerOneMb = append(entriesLargerOneMb, longLogEntry)
 	}
-	entry, err := convertFluentbitEntriesToJson(entriesLargerOneMb)
+	payloads := buildPayloads(&AzureOperator{}, entriesLargerOneMb)
 
-	assert.NoError(t, err)
-	assert.Len(t, entry, 2)
+	assert.Len(t, payloads, 2)
 }
 
 func generateDummyFluentbitLogEntry() FluentbitLogEntry {
@@ -118,14 +138,14 @@ func generateDummyFluentbitLogEntry() FluentbitLogEntry {
 
 func generateDummyFluentbitLogEntryWithLog(log string) FluentbitLogEntry {
 	return FluentbitLogEntry{
-		TimeGenerated:           time.Now().UTC().Format(time.RFC3339Nano),
-		KubernetesPodName:       "datafy-pyspark-sample-b7b8ff96c4335653-exec-1",
-		KubernetesNamespaceName: "namespace",
-		KubernetesHost:          "aks-sd8sv51313-14978311-vmss000004",
-		KubernetesDockerId:      "aks-sd8sv51313-14978311-vmss000004",
-		KubernetesContainerName: "my-base-container",
-		Log:                     log,
-		Stream:                  "info",
+		"TimeGenerated":             time.Now().UTC().Format(time.RFC3339Nano),
+		"kubernetes_pod_name":       "datafy-pyspark-sample-b7b8ff96c4335653-exec-1",
+		"kubernetes_namespace_name": "namespace",
+		"kubernetes_host":           "aks-sd8sv51313-14978311-vmss000004",
+		"kubernetes_docker_id":      "aks-sd8sv51313-14978311-vmss000004",
+		"kubernetes_container_name": "my-base-container",
+		"log":                       log,
+		"stream":                    "info",
 	}
 }
 
@@ -0,0 +1,205 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type oversizedStrategy string
+
+const (
+	oversizedTruncate   oversizedStrategy = "truncate"
+	oversizedSplit      oversizedStrategy = "split"
+	oversizedDeadLetter oversizedStrategy = "dead_letter"
+
+	logColumn          = "log"
+	logPartIdColumn    = "log_part_id"
+	logPartIndexColumn = "log_part_index"
+	logPartCountColumn = "log_part_count"
+	truncatedMarker    = "...[truncated]"
+
+	// maxRecordSize is the largest record that fits in a request on its own.
+	maxRecordSize = oneMb - extraBufferHundredBytes - 2
+)
+
+var errRecordTooLarge = errors.New("record is larger than the maximum request size")
+
+// oversizedRecords makes records that do not fit in a single request small enough to be sent, or dead-letters them.
+type oversizedRecords struct {
+	strategy   oversizedStrategy
+	deadLetter *deadLetterSink
+	maxSize    int
+	logger     zerolog.Logger
+}
+
+func newOversizedRecords(strategy string, deadLetter *deadLetterSink) (oversizedRecords, error) {
+	switch oversizedStrategy(strategy) {
+	case "":
+		strategy = string(oversizedTruncate)
+	case oversizedTruncate, oversizedSplit:
+	case oversizedDeadLetter:
+		if deadLetter == nil {
+			return oversizedRecords{}, errors.New("the dead_letter strategy for oversized records requires DeadLetterDir to be configured")
+		}
+	default:
+		return oversizedRecords{}, fmt.Errorf("unknown strategy %q for oversized records, expected %s, %s or %s", strategy, oversizedTruncate, oversizedSplit, oversizedDeadLetter)
+	}
+	return oversizedRecords{strategy: oversizedStrategy(strategy), deadLetter: deadLetter, maxSize: maxRecordSize, logger: log.Logger}, nil
+}
+
+// fit returns the JSON rows to send for an entry whose JSON value is larger than the maximum record size.
+// The parts of a split entry carry partId, see newPartId.
+func (o oversizedRecords) fit(entry FluentbitLogEntry, jsonValue []byte, partId string, destination Destination, tag string) [][]byte {
+	var rows [][]byte
+	var err error
+	switch o.strategy {
+	case oversizedSplit:
+		rows, err = o.split(entry, partId)
+	case oversizedDeadLetter:
+		err = errRecordTooLarge
+	default:
+		rows, err = o.truncate(entry)
+	}
+	if err == nil {
+		return rows
+	}
+	if o.deadLetter == nil {
+		o.logger.Err(err).Msgf("[azurelogsingestion] Dropping record of %d bytes for stream %s", len(jsonValue), destination.StreamName)
+		return nil
+	}
+	o.logger.Err(err).Msgf("[azurelogsingestion] Writing record of %d bytes for stream %s to the dead-letter directory", len(jsonValue), destination.StreamName)
+	batch := Batch{Destination: destination, Tag: tag, Payload: append(append([]byte("["), jsonValue...), ']')}
+	if deadLetterErr := o.deadLetter.write(batch, err); deadLetterErr != nil {
+		o.logger.Err(deadLetterErr).Msg("[azurelogsingestion] Failed to dead-letter oversized record")
+	}
+	return nil
+}
+
+func (o oversizedRecords) truncate(entry FluentbitLogEntry) ([][]byte, error) {
+	logValue, ok := entry[logColumn].(string)
+	if !ok {
+		return nil, errors.Wrap(errRecordTooLarge, "record has no log field to truncate")
+	}
+	truncated := copyEntry(entry)
+	row, err := o.fitString(logValue, func(prefix string) ([]byte, error) {
+		truncated[logColumn] = prefix + truncatedMarker
+		return json.Marshal(truncated)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{row}, nil
+}
+
+// split spreads the log field over several rows, which share a part id and carry their part index.
+func (o oversizedRecords) split(entry FluentbitLogEntry, partId string) ([][]byte, error) {
+	logValue, ok := entry[logColumn].(string)
+	if !ok {
+		return nil, errors.Wrap(errRecordTooLarge, "record has no log field to split")
+	}
+	var parts []string
+	remaining := logValue
+	for len(remaining) > 0 {
+		part := copyEntry(entry)
+		part[logPartIdColumn] = partId
+		// Reserve room for the index and count, which are only known once all parts are created.
+		part[logPartIndexColumn] = 999999
+		part[logPartCountColumn] = 999999
+		prefixLength := 0
+		_, err := o.fitString(remaining, func(prefix string) ([]byte, error) {
+			part[logColumn] = prefix
+			prefixLength = len(prefix)
+			return json.Marshal(part)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if prefixLength == 0 {
+			return nil, errors.Wrap(errRecordTooLarge, "fields other than log do not fit in a request")
+		}
+		parts = append(parts, remaining[:prefixLength])
+		remaining = remaining[prefixLength:]
+	}
+	rows := make([][]byte, 0, len(parts))
+	for idx, value := range parts {
+		part := copyEntry(entry)
+		part[logColumn] = value
+		part[logPartIdColumn] = partId
+		part[logPartIndexColumn] = idx
+		part[logPartCountColumn] = len(parts)
+		row, err := json.Marshal(part)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// fitString returns the JSON built from the longest prefix of value, cut at a rune boundary, that fits in maxSize.
+func (o oversizedRecords) fitString(value string, build func(prefix string) ([]byte, error)) ([]byte, error) {
+	empty, err := build("")
+	if err != nil {
+		return nil, err
+	}
+	if len(empty) > o.maxSize {
+		return nil, errors.Wrap(errRecordTooLarge, "fields other than log do not fit in a request")
+	}
+	allowed := o.maxSize - len(empty)
+	length := len(value)
+	for length > 0 {
+		for length < len(value) && !utf8.RuneStart(value[length]) {
+			length--
+		}
+		row, err := build(value[:length])
+		if err != nil {
+			return nil, err
+		}
+		if len(row) <= o.maxSize {
+			return row, nil
+		}
+		// Escaping makes the encoded value longer than the prefix, so shrink it proportionally.
+		encoded := len(row) - len(empty)
+		length = min(length-1, length*allowed/encoded)
+	}
+	return build("")
+}
+
+func copyEntry(entry FluentbitLogEntry) FluentbitLogEntry {
+	copied := make(FluentbitLogEntry, len(entry)+3)
+	for k, v := range entry {
+		copied[k] = v
+	}
+	return copied
+}
+
+// newPartId derives the part id of a record from its chunk and its index in the chunk. A retried chunk produces
+// the same parts, so batches that were already delivered are recognized and not sent again.
+func newPartId(chunk chunkID, index int) string {
+	hash := sha256.New()
+	hash.Write(chunk[:])
+	hash.Write([]byte(strconv.Itoa(index)))
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOversizedRecords_validatesStrategy(t *testing.T) {
+	oversized, err := newOversizedRecords("", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, oversizedTruncate, oversized.strategy)
+
+	_, err = newOversizedRecords("dead_letter", nil)
+	assert.Error(t, err)
+
+	_, err = newOversizedRecords("ignore", nil)
+	assert.Error(t, err)
+}
+
+func TestOversizedRecords_truncate_fitsWithMarker(t *testing.T) {
+	oversized := oversizedRecords{strategy: oversizedTruncate, maxSize: 100}
+	entry := FluentbitLogEntry{"TimeGenerated": "2025-05-12T12:00:00Z", "log": strings.Repeat("é", 200)}
+
+	rows := oversized.fit(entry, nil, "part-1", spoolDestination, "kube.app")
+
+	assert.Len(t, rows, 1)
+	assert.LessOrEqual(t, len(rows[0]), 100)
+	var truncated FluentbitLogEntry
+	assert.NoError(t, json.Unmarshal(rows[0], &truncated))
+	assert.True(t, strings.HasSuffix(truncated["log"].(string), truncatedMarker))
+	assert.True(t, strings.HasPrefix(truncated["log"].(string), "éé"))
+	assert.Equal(t, "2025-05-12T12:00:00Z", truncated["TimeGenerated"])
+}
+
+func TestOversizedRecords_split_createsPartsWithSharedId(t *testing.T) {
+	oversized := oversizedRecords{strategy: oversizedSplit, maxSize: 200}
+	logValue := strings.Repeat("0123456789\"", 60)
+	entry := FluentbitLogEntry{"TimeGenerated": "2025-05-12T12:00:00Z", "log": logValue}
+
+	rows := oversized.fit(entry, nil, "part-1", spoolDestination, "kube.app")
+
+	assert.Greater(t, len(rows), 1)
+	var reassembled strings.Builder
+	var partId string
+	for idx, row := range rows {
+		assert.LessOrEqual(t, len(row), 200)
+		var part FluentbitLogEntry
+		assert.NoError(t, json.Unmarshal(row, &part))
+		if idx == 0 {
+			partId = part[logPartIdColumn].(string)
+		}
+		assert.Equal(t, partId, part[logPartIdColumn])
+		assert.Equal(t, float64(idx), part[logPartIndexColumn])
+		assert.Equal(t, float64(len(rows)), part[logPartCountColumn])
+		reassembled.WriteString(part["log"].(string))
+	}
+	assert.Equal(t, logValue, reassembled.String())
+}
+
+func TestOversizedRecords_noLogField_dropsRecord(t *testing.T) {
+	oversized := oversizedRecords{strategy: oversizedTruncate, maxSize: 100}
+	entry := FluentbitLogEntry{"message": strings.Repeat("a", 200)}
+
+	assert.Empty(t, oversized.fit(entry, nil, "part-1", spoolDestination, "kube.app"))
+}
+
+func TestOversizedRecords_deadLetter_writesRecord(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := newDeadLetterSink(dir, 0, time.Hour)
+	assert.NoError(t, err)
+	oversized, err := newOversizedRecords("dead_letter", sink)
+	assert.NoError(t, err)
+	entry := FluentbitLogEntry{"log": "large"}
+	jsonValue, _ := json.Marshal(entry)
+
+	rows := oversized.fit(entry, jsonValue, "part-1", spoolDestination, "kube.app")
+
+	assert.Empty(t, rows)
+	entries := readDeadLetterEntries(t, dir)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "kube.app", entries[0].Tag)
+	assert.JSONEq(t, `[{"log":"large"}]`, string(entries[0].Records))
+}
+
+func TestBatchBuilder_recordLargerThan1Megabyte_isTruncated(t *testing.T) {
+	oversized, _ := newOversizedRecords("", nil)
+	large := generateDummyFluentbitLogEntryWithLog(strings.Repeat("a", 2*oneMb))
+	small := generateDummyFluentbitLogEntry()
+
+	payloads := buildPayloads(&AzureOperator{oversized: oversized}, []FluentbitLogEntry{small, large, small})
+
+	assert.Len(t, payloads, 3)
+	for _, payload := range payloads {
+		assert.LessOrEqual(t, len(payload), oneMb)
+	}
+	assert.Len(t, reverseEntries(t, payloads), 3)
+}
+
+func TestBatchBuilder_splitRecord_retriedChunkProducesSamePayloads(t *testing.T) {
+	oversized, _ := newOversizedRecords("split", nil)
+	large := generateDummyFluentbitLogEntryWithLog(strings.Repeat("a", 2*oneMb))
+	small := generateDummyFluentbitLogEntry()
+
+	first := buildPayloads(&AzureOperator{oversized: oversized}, []FluentbitLogEntry{small, large})
+	retried := buildPayloads(&AzureOperator{oversized: oversized}, []FluentbitLogEntry{small, large})
+
+	assert.Greater(t, len(first), 1)
+	assert.Equal(t, first, retried)
+}
+
+func TestNewPartId_dependsOnChunkAndIndex(t *testing.T) {
+	chunk := newChunkID("kube.app", []byte("chunk"))
+
+	assert.Equal(t, newPartId(chunk, 1), newPartId(chunk, 1))
+	assert.NotEqual(t, newPartId(chunk, 1), newPartId(chunk, 2))
+	assert.NotEqual(t, newPartId(chunk, 1), newPartId(newChunkID("kube.app", []byte("other")), 1))
+	assert.Len(t, newPartId(chunk, 1), 32)
+}
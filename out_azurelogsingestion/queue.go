@@ -0,0 +1,218 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultQueueMaxBatches = 1000
+	minRetryBackoff        = time.Second
+	maxRetryBackoff        = 30 * time.Second
+)
+
+var (
+	errQueueFull   = errors.New("send queue is full")
+	errQueueClosed = errors.New("send queue is closed")
+)
+
+// sendQueue buffers batches in memory so a flush does not wait for the uploads to Azure.
+// Background senders upload the batches and retry them until they succeed.
+type sendQueue struct {
+	mutex      sync.Mutex
+	available  *sync.Cond
+	batches    []Batch
+	bytes      int
+	maxBytes   int
+	maxBatches int
+	pending    int
+	closed     bool
+	aborted    bool
+	abort      chan struct{}
+	senders    sync.WaitGroup
+	// retried is called before a batch is sent again, when it is set.
+	retried func(Batch)
+	logger  zerolog.Logger
+}
+
+func newSendQueue(maxBytes int, maxBatches int) *sendQueue {
+	q := &sendQueue{maxBytes: maxBytes, maxBatches: maxBatches, abort: make(chan struct{}), logger: log.Logger}
+	q.available = sync.NewCond(&q.mutex)
+	return q
+}
+
+// enqueue adds all batches of a flush to the queue or none of them when they do not fit.
+// A flush that is larger than the queue is accepted when the queue is empty, otherwise it could never be sent.
+func (q *sendQueue) enqueue(batches []Batch) error {
+	size := 0
+	for _, batch := range batches {
+		size += len(batch.Payload)
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return errQueueClosed
+	}
+	if q.pending > 0 && (q.bytes+size > q.maxBytes || q.pending+len(batches) > q.maxBatches) {
+		return errQueueFull
+	}
+	q.batches = append(q.batches, batches...)
+	q.bytes += size
+	q.pending += len(batches)
+	q.available.Broadcast()
+	return nil
+}
+
+// next blocks until a batch is available and removes it from the queue, it returns false once the queue is closed and empty.
+// The batch keeps counting towards the limits of the queue until done is called.
+func (q *sendQueue) next() (Batch, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.batches) == 0 || q.aborted {
+		if q.closed {
+			return Batch{}, false
+		}
+		q.available.Wait()
+	}
+	batch := q.batches[0]
+	q.batches[0] = Batch{}
+	q.batches = q.batches[1:]
+	return batch, true
+}
+
+func (q *sendQueue) done(batch Batch) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.bytes -= len(batch.Payload)
+	q.pending--
+}
+
+// depth returns the number of batches and bytes that are queued or being uploaded.
+func (q *sendQueue) depth() (int, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.pending, q.bytes
+}
+
+// start launches the background senders, which upload batches until they succeed.
+// send is called with the number of earlier attempts to send the batch.
+func (q *sendQueue) start(senders int, send func(batch Batch, attempt int) error) {
+	for range senders {
+		q.senders.Add(1)
+		go func() {
+			defer q.senders.Done()
+			for {
+				batch, ok := q.next()
+				if !ok {
+					return
+				}
+				if !sendWithRetry(batch, q.countRetries(send), q.abort, q.logger) {
+					q.requeue(batch)
+					return
+				}
+				q.done(batch)
+				releaseBatches([]Batch{batch})
+			}
+		}()
+	}
+}
+
+func (q *sendQueue) countRetries(send func(Batch, int) error) func(Batch, int) error {
+	if q.retried == nil {
+		return send
+	}
+	return func(batch Batch, attempt int) error {
+		if attempt > 0 {
+			q.retried(batch)
+		}
+		return send(batch, attempt)
+	}
+}
+
+// requeue puts a batch that was not sent back at the front of the queue.
+func (q *sendQueue) requeue(batch Batch) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.batches = append([]Batch{batch}, q.batches...)
+}
+
+// close stops accepting batches and waits until the senders have uploaded the queued batches or ctx is done.
+// The senders then stop retrying and the batches that were not sent are passed to abandon.
+func (q *sendQueue) close(ctx context.Context, abandon func(Batch)) {
+	q.mutex.Lock()
+	q.closed = true
+	q.available.Broadcast()
+	q.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.senders.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return
+	case <-ctx.Done():
+	}
+	q.mutex.Lock()
+	q.aborted = true
+	q.mutex.Unlock()
+	close(q.abort)
+	<-drained
+
+	q.mutex.Lock()
+	remaining := q.batches
+	q.batches = nil
+	q.mutex.Unlock()
+	for _, batch := range remaining {
+		abandon(batch)
+		q.done(batch)
+	}
+}
+
+// sendWithRetry sends the batch until it succeeds and returns false when abort is closed before that.
+func sendWithRetry(batch Batch, send func(Batch, int) error, abort <-chan struct{}, logger zerolog.Logger) bool {
+	for attempt := 0; ; attempt++ {
+		err := send(batch, attempt)
+		if err == nil {
+			return true
+		}
+		backoff := max(retryBackoff(attempt), retryAfter(err, time.Now()))
+		logger.Err(err).Msgf("[azurelogsingestion] Failed to send queued logs to azure, retrying in %s", backoff)
+		select {
+		case <-abort:
+			return false
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func retryBackoff(attempt int) time.Duration {
+	backoff := minRetryBackoff
+	for range attempt {
+		backoff *= 2
+		if backoff >= maxRetryBackoff {
+			return maxRetryBackoff
+		}
+	}
+	return backoff
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendQueue_enqueue_rejectsWhenBytesExceeded(t *testing.T) {
+	queue := newSendQueue(10, 100)
+
+	assert.NoError(t, queue.enqueue([]Batch{{Payload: []byte("12345678")}}))
+	assert.ErrorIs(t, queue.enqueue([]Batch{{Payload: []byte("123")}}), errQueueFull)
+
+	batches, bytes := queue.depth()
+	assert.Equal(t, 1, batches)
+	assert.Equal(t, 8, bytes)
+}
+
+func TestSendQueue_enqueue_rejectsWhenBatchesExceeded(t *testing.T) {
+	queue := newSendQueue(100, 2)
+
+	assert.NoError(t, queue.enqueue([]Batch{{Payload: []byte("1")}}))
+	assert.ErrorIs(t, queue.enqueue([]Batch{{Payload: []byte("2")}, {Payload: []byte("3")}}), errQueueFull)
+}
+
+func TestSendQueue_enqueue_acceptsLargeFlushWhenEmpty(t *testing.T) {
+	queue := newSendQueue(2, 100)
+
+	assert.NoError(t, queue.enqueue([]Batch{{Payload: []byte("123456")}}))
+}
+
+func TestSendQueue_start_sendsAndReleasesBatches(t *testing.T) {
+	queue := newSendQueue(100, 100)
+	var sent atomic.Int32
+	queue.start(2, func(batch Batch, _ int) error {
+		sent.Add(1)
+		return nil
+	})
+
+	assert.NoError(t, queue.enqueue([]Batch{{Payload: []byte("1")}, {Payload: []byte("2")}, {Payload: []byte("3")}}))
+
+	assert.Eventually(t, func() bool {
+		batches, bytes := queue.depth()
+		return sent.Load() == 3 && batches == 0 && bytes == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestSendWithRetry_retriesUntilSuccess(t *testing.T) {
+	calls := 0
+
+	sendWithRetry(Batch{}, func(batch Batch, _ int) error {
+		calls++
+		if calls == 1 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}, nil, zerolog.Nop())
+
+	assert.Equal(t, 2, calls)
+}
+
+func TestRetryBackoff_isCapped(t *testing.T) {
+	assert.Equal(t, minRetryBackoff, retryBackoff(0))
+	assert.Equal(t, 4*time.Second, retryBackoff(2))
+	assert.Equal(t, maxRetryBackoff, retryBackoff(10))
+}
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int{"": 0, "512": 512, "10K": 10 << 10, "10kb": 10 << 10, "5M": 5 << 20, "1GB": 1 << 30} {
+		size, err := parseSize(value)
+
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, size, value)
+	}
+	_, err := parseSize("ten")
+	assert.Error(t, err)
+}
@@ -0,0 +1,236 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+type retryAction string
+
+const (
+	actionRetry      retryAction = "retry"
+	actionDrop       retryAction = "drop"
+	actionDeadLetter retryAction = "dead_letter"
+	// actionSplit uploads the two halves of a batch separately, for requests that Azure rejects as too large.
+	actionSplit retryAction = "split"
+)
+
+// defaultRetryPolicy drops malformed requests and requests for a DCR or stream that does not exist, as they will never
+// succeed and would otherwise block the batches behind them. Other errors are retried, so no logs are lost while for
+// example a role assignment propagates. When a dead-letter location is configured, client errors other than
+// authentication, authorization, timeout and throttling errors are dead-lettered instead.
+const (
+	defaultRetryPolicy           = "400=drop, 404=drop, 413=split, 4xx=retry, 5xx=retry"
+	defaultDeadLetterRetryPolicy = "401=retry, 403=retry, 408=retry, 413=split, 429=retry, 4xx=dead_letter, 5xx=retry"
+)
+
+// RetryPolicy decides what happens with a batch that Azure rejected, based on the HTTP status code.
+// Errors without a status code, such as network errors, are always retried.
+type RetryPolicy struct {
+	byStatus map[int]retryAction
+	byClass  map[int]retryAction
+}
+
+// parseRetryPolicy parses rules of the form <status>=<action>, where status is a code like 403 or a class like 4xx.
+// The rules are applied on top of the default policy.
+func parseRetryPolicy(spec string, deadLetter bool) (RetryPolicy, error) {
+	policy := RetryPolicy{byStatus: map[int]retryAction{}, byClass: map[int]retryAction{}}
+	defaults := defaultRetryPolicy
+	if deadLetter {
+		defaults = defaultDeadLetterRetryPolicy
+	}
+	for _, rules := range []string{defaults, spec} {
+		for _, rule := range strings.Split(rules, ",") {
+			rule = strings.TrimSpace(rule)
+			if rule == "" {
+				continue
+			}
+			status, rawAction, found := strings.Cut(rule, "=")
+			if !found {
+				return RetryPolicy{}, fmt.Errorf("invalid retry rule %q, expected <status>=<action>", rule)
+			}
+			action, err := parseRetryAction(strings.TrimSpace(rawAction))
+			if err != nil {
+				return RetryPolicy{}, err
+			}
+			if action == actionDeadLetter && !deadLetter {
+				return RetryPolicy{}, fmt.Errorf("retry rule %q requires DeadLetterDir to be configured", rule)
+			}
+			status = strings.ToLower(strings.TrimSpace(status))
+			if len(status) == 3 && strings.HasSuffix(status, "xx") && status[0] >= '1' && status[0] <= '5' {
+				policy.byClass[int(status[0]-'0')] = action
+				continue
+			}
+			code, err := strconv.Atoi(status)
+			if err != nil || code < 100 || code > 599 {
+				return RetryPolicy{}, fmt.Errorf("invalid status %q in retry rule %q", status, rule)
+			}
+			policy.byStatus[code] = action
+		}
+	}
+	return policy, nil
+}
+
+func parseRetryAction(action string) (retryAction, error) {
+	switch retryAction(action) {
+	case actionRetry, actionDrop, actionDeadLetter, actionSplit:
+		return retryAction(action), nil
+	default:
+		return "", fmt.Errorf("unknown retry action %q, expected %s, %s, %s or %s", action, actionRetry, actionDrop, actionDeadLetter, actionSplit)
+	}
+}
+
+// classify returns the action for an upload error.
+func (p RetryPolicy) classify(err error) retryAction {
+	var responseErr *azcore.ResponseError
+	if !errors.As(err, &responseErr) {
+		return actionRetry
+	}
+	if action, ok := p.byStatus[responseErr.StatusCode]; ok {
+		return action
+	}
+	if action, ok := p.byClass[responseErr.StatusCode/100]; ok {
+		return action
+	}
+	return actionRetry
+}
+
+// rejectedError is returned for a batch that Azure rejected permanently but that could not be dead-lettered or split.
+// Sending it again cannot succeed, so the queue and the spool move on to the next batch instead of retrying it.
+type rejectedError struct {
+	err error
+}
+
+func (e rejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e rejectedError) Unwrap() error {
+	return e.err
+}
+
+func isRejected(err error) bool {
+	var rejected rejectedError
+	return errors.As(err, &rejected)
+}
+
+// isThrottled reports whether Azure asked to slow down. Such batches are retried from memory instead of being spooled,
+// as they will be accepted once the Retry-After period has passed.
+func isThrottled(err error) bool {
+	var throttled throttledError
+	if errors.As(err, &throttled) {
+		return true
+	}
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusTooManyRequests
+}
+
+// throttledError is returned while an operator waits for the Retry-After period that Azure requested.
+type throttledError struct {
+	until time.Time
+}
+
+func (e throttledError) Error() string {
+	return fmt.Sprintf("throttled by azure until %s", e.until.Format(time.RFC3339))
+}
+
+// throttle remembers until when Azure asked us not to send requests.
+type throttle struct {
+	until atomic.Int64
+}
+
+func (t *throttle) check(now time.Time) error {
+	until := t.until.Load()
+	if until > now.UnixNano() {
+		return throttledError{until: time.Unix(0, until)}
+	}
+	return nil
+}
+
+func (t *throttle) extend(until time.Time) {
+	for {
+		current := t.until.Load()
+		if current >= until.UnixNano() || t.until.CompareAndSwap(current, until.UnixNano()) {
+			return
+		}
+	}
+}
+
+// throttles holds a throttle per destination, so a destination that Azure throttles does not hold back the others.
+type throttles struct {
+	mutex         sync.Mutex
+	byDestination map[Destination]*throttle
+}
+
+func (t *throttles) get(destination Destination) *throttle {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.byDestination == nil {
+		t.byDestination = map[Destination]*throttle{}
+	}
+	th, ok := t.byDestination[destination]
+	if !ok {
+		th = &throttle{}
+		t.byDestination[destination] = th
+	}
+	return th
+}
+
+// retryAfter returns how long Azure asked to wait before the next request, or 0 when it did not.
+func retryAfter(err error, now time.Time) time.Duration {
+	var throttled throttledError
+	if errors.As(err, &throttled) {
+		return throttled.until.Sub(now)
+	}
+	var responseErr *azcore.ResponseError
+	if !errors.As(err, &responseErr) || responseErr.RawResponse == nil {
+		return 0
+	}
+	return parseRetryAfter(responseErr.RawResponse.Header, now)
+}
+
+func parseRetryAfter(header http.Header, now time.Time) time.Duration {
+	for _, name := range []string{"retry-after-ms", "x-ms-retry-after-ms"} {
+		if value := header.Get(name); value != "" {
+			if ms, err := strconv.Atoi(value); err == nil && ms > 0 {
+				return time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		return 0
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func responseError(status int, header http.Header) error {
+	return &azcore.ResponseError{StatusCode: status, RawResponse: &http.Response{StatusCode: status, Header: header}}
+}
+
+func TestParseRetryPolicy_default(t *testing.T) {
+	policy, err := parseRetryPolicy("", false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, actionDrop, policy.classify(responseError(400, nil)))
+	assert.Equal(t, actionRetry, policy.classify(responseError(401, nil)))
+	assert.Equal(t, actionRetry, policy.classify(responseError(403, nil)))
+	assert.Equal(t, actionDrop, policy.classify(responseError(404, nil)))
+	assert.Equal(t, actionRetry, policy.classify(responseError(408, nil)))
+	assert.Equal(t, actionSplit, policy.classify(responseError(413, nil)))
+	assert.Equal(t, actionRetry, policy.classify(responseError(429, nil)))
+	assert.Equal(t, actionRetry, policy.classify(responseError(503, nil)))
+	assert.Equal(t, actionRetry, policy.classify(errors.New("connection refused")))
+}
+
+func TestParseRetryPolicy_overridesDefault(t *testing.T) {
+	policy, err := parseRetryPolicy("4xx=drop, 403=retry, 5xx=drop", false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, actionRetry, policy.classify(responseError(403, nil)))
+	assert.Equal(t, actionDrop, policy.classify(responseError(401, nil)))
+	assert.Equal(t, actionSplit, policy.classify(responseError(413, nil)))
+	assert.Equal(t, actionDrop, policy.classify(fmt.Errorf("wrapped: %w", responseError(500, nil))))
+}
+
+func TestParseRetryPolicy_invalidRules_returnsError(t *testing.T) {
+	for _, spec := range []string{"403", "403=ignore", "99=drop", "6xx=drop", "abc=retry", "400=dead_letter"} {
+		_, err := parseRetryPolicy(spec, false)
+
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestParseRetryPolicy_deadLetterConfigured_deadLettersClientErrors(t *testing.T) {
+	policy, err := parseRetryPolicy("", true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, actionDeadLetter, policy.classify(responseError(400, nil)))
+	assert.Equal(t, actionRetry, policy.classify(responseError(401, nil)))
+	assert.Equal(t, actionRetry, policy.classify(responseError(403, nil)))
+	assert.Equal(t, actionRetry, policy.classify(responseError(429, nil)))
+}
+
+func TestRetryAfter_readsHeaders(t *testing.T) {
+	now := time.Date(2025, 5, 12, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 30*time.Second, retryAfter(responseError(429, http.Header{"Retry-After": {"30"}}), now))
+	assert.Equal(t, 1500*time.Millisecond, retryAfter(responseError(429, http.Header{"Retry-After-Ms": {"1500"}}), now))
+	assert.Equal(t, 2*time.Minute, retryAfter(responseError(429, http.Header{"Retry-After": {now.Add(2 * time.Minute).Format(http.TimeFormat)}}), now))
+	assert.Equal(t, time.Duration(0), retryAfter(responseError(429, nil), now))
+	assert.Equal(t, time.Duration(0), retryAfter(errors.New("connection refused"), now))
+}
+
+func TestThrottle_checkAndExtend(t *testing.T) {
+	now := time.Now()
+	var th throttle
+
+	assert.NoError(t, th.check(now))
+	th.extend(now.Add(time.Minute))
+	th.extend(now.Add(time.Second))
+
+	err := th.check(now)
+	assert.Error(t, err)
+	assert.InDelta(t, time.Minute, retryAfter(err, now), float64(time.Millisecond))
+	assert.NoError(t, th.check(now.Add(2*time.Minute)))
+}
+
+func TestUpload_forbidden_retriesByDefault(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	policy, _ := parseRetryPolicy("", false)
+	operator := &AzureOperator{logsClient: mockClient, retryPolicy: policy}
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(403, nil))
+
+	assert.Error(t, operator.upload(Batch{}))
+}
+
+func TestUpload_badRequest_dropsAndCountsBatchByDefault(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	policy, _ := parseRetryPolicy("", false)
+	operator := &AzureOperator{logsClient: mockClient, retryPolicy: policy, metrics: newTestMetrics()}
+	destination := Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-logs"}
+	dropped := recordsDropped.With(prometheus.Labels{"instance": operator.metrics.instance, "stream": "Custom-logs", "dcr": "dcr-1", "reason": dropReasonRejected})
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(400, nil))
+
+	assert.NoError(t, operator.upload(Batch{Destination: destination, Payload: []byte(`[{"log":"1"},{"log":"2"}]`), Records: 2}))
+	assert.Equal(t, 2.0, testutil.ToFloat64(dropped))
+}
+
+func TestUpload_throttled_skipsUploadUntilRetryAfter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	policy, _ := parseRetryPolicy("", false)
+	operator := &AzureOperator{logsClient: mockClient, retryPolicy: policy}
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(429, http.Header{"Retry-After": {"60"}})).Times(1)
+
+	assert.Error(t, operator.upload(Batch{}))
+	err := operator.upload(Batch{})
+	var throttled throttledError
+	assert.ErrorAs(t, err, &throttled)
+}
+
+func TestUpload_throttled_doesNotHoldBackOtherDestinations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	policy, _ := parseRetryPolicy("", false)
+	operator := &AzureOperator{logsClient: mockClient, retryPolicy: policy}
+	throttled := Batch{Destination: Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-logs"}}
+	other := Batch{Destination: Destination{DcrImmutableId: "dcr-2", StreamName: "Custom-logs"}}
+
+	mockClient.EXPECT().Upload(gomock.Any(), "dcr-1", gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(429, http.Header{"Retry-After": {"60"}})).Times(1)
+	mockClient.EXPECT().Upload(gomock.Any(), "dcr-2", gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, nil)
+
+	assert.Error(t, operator.upload(throttled))
+	assert.Error(t, operator.upload(throttled))
+	assert.NoError(t, operator.upload(other))
+}
+
+func TestUpload_tooLarge_splitsBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	policy, _ := parseRetryPolicy("", false)
+	operator := &AzureOperator{logsClient: mockClient, retryPolicy: policy}
+
+	gomock.InOrder(
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), []byte(`[{"log":"1"},{"log":"2"},{"log":"3"}]`), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(413, nil)),
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), []byte(`[{"log":"1"}]`), gomock.Any()).Return(azlogs.UploadResponse{}, nil),
+		mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), []byte(`[{"log":"2"},{"log":"3"}]`), gomock.Any()).Return(azlogs.UploadResponse{}, nil),
+	)
+
+	assert.NoError(t, operator.upload(Batch{Payload: []byte(`[{"log":"1"},{"log":"2"},{"log":"3"}]`), Records: 3}))
+}
+
+func TestUpload_tooLargeSingleRecord_isDroppedAndCounted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	policy, _ := parseRetryPolicy("", false)
+	operator := &AzureOperator{logsClient: mockClient, retryPolicy: policy, metrics: newTestMetrics()}
+	destination := Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-logs"}
+	dropped := recordsDropped.With(prometheus.Labels{"instance": operator.metrics.instance, "stream": "Custom-logs", "dcr": "dcr-1", "reason": dropReasonRejected})
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(413, nil))
+
+	assert.NoError(t, operator.upload(Batch{Destination: destination, Payload: []byte(`[{"log":"1"}]`), Records: 1}))
+	assert.Equal(t, 1.0, testutil.ToFloat64(dropped))
+}
+
+func TestDeliver_rejectedWithoutSpool_dropsBatchSoTheQueueMovesOn(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	policy, _ := parseRetryPolicy("", false)
+	operator := &AzureOperator{logsClient: mockClient, retryPolicy: policy, metrics: newTestMetrics()}
+	destination := Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-logs"}
+	dropped := recordsDropped.With(prometheus.Labels{"instance": operator.metrics.instance, "stream": "Custom-logs", "dcr": "dcr-1", "reason": dropReasonRejected})
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(413, nil))
+
+	assert.NoError(t, operator.deliver(Batch{Destination: destination, Payload: []byte(`not json`), Records: 3}, true))
+	assert.Equal(t, 3.0, testutil.ToFloat64(dropped))
+}
@@ -0,0 +1,212 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Destination identifies where a batch of logs is uploaded to.
+type Destination struct {
+	Endpoint       string
+	DcrImmutableId string
+	StreamName     string
+}
+
+// Route sends all records with a tag matching TagPattern to Destination.
+type Route struct {
+	TagPattern  string
+	Destination Destination
+}
+
+// parseRoutes parses route definitions of the form "<tag glob> <dcr immutable id> <stream name> [endpoint]",
+// separated by commas or newlines. The endpoint of the output is used when a route does not specify one.
+func parseRoutes(spec string) ([]Route, error) {
+	var routes []Route
+	for _, line := range strings.Split(spec, "\n") {
+		for _, definition := range strings.Split(line, ",") {
+			fields := strings.Fields(definition)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) < 3 || len(fields) > 4 {
+				return nil, fmt.Errorf("invalid route %q, expected <tag> <dcr immutable id> <stream name> [endpoint]", strings.TrimSpace(definition))
+			}
+			if _, err := path.Match(fields[0], ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid tag pattern %s", fields[0])
+			}
+			route := Route{
+				TagPattern: fields[0],
+				Destination: Destination{
+					DcrImmutableId: fields[1],
+					StreamName:     fields[2],
+				},
+			}
+			if len(fields) == 4 {
+				route.Destination.Endpoint = fields[3]
+			}
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+// defaultDestination is the destination configured by the Endpoint, DcrImmutableId and StreamName keys.
+func (c AzureConfig) defaultDestination() Destination {
+	return Destination{
+		Endpoint:       c.Endpoint,
+		DcrImmutableId: c.DcrImmutableId,
+		StreamName:     c.StreamName,
+	}
+}
+
+// resolveDestination returns the destination of the first route matching the tag.
+// When no route matches, the default destination is used if it is configured.
+func (c AzureConfig) resolveDestination(tag string) (Destination, bool) {
+	for _, route := range c.Routes {
+		if matched, _ := path.Match(route.TagPattern, tag); matched {
+			destination := route.Destination
+			if destination.Endpoint == "" {
+				destination.Endpoint = c.Endpoint
+			}
+			return destination, true
+		}
+	}
+	destination := c.defaultDestination()
+	if destination.DcrImmutableId == "" || destination.StreamName == "" {
+		return Destination{}, false
+	}
+	return destination, true
+}
+
+// validateDestinations rejects an output that cannot send any record, as it has neither a complete default destination
+// nor any routes. Records that no route matches are only sent when DcrImmutableId and StreamName are both configured.
+func validateDestinations(output Destination, routes []Route, recordRoutes []RecordRoute) error {
+	if output.DcrImmutableId != "" && output.StreamName != "" {
+		return nil
+	}
+	if len(routes) > 0 || len(recordRoutes) > 0 {
+		return nil
+	}
+	return errors.New("DcrImmutableId and StreamName, or at least one of Routes and RecordRoutes, must be configured")
+}
+
+// RecordRoute sends all records where the value at Path matches ValuePattern to Destination.
+type RecordRoute struct {
+	Path         []string
+	ValuePattern string
+	Destination  Destination
+}
+
+// parseRecordRoutes parses route definitions of the form "<record.path>=<value glob> <dcr immutable id> <stream name> [endpoint]",
+// separated by commas or newlines.
+func parseRecordRoutes(spec string) ([]RecordRoute, error) {
+	var routes []RecordRoute
+	for _, line := range strings.Split(spec, "\n") {
+		for _, definition := range strings.Split(line, ",") {
+			fields := strings.Fields(definition)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) < 3 || len(fields) > 4 {
+				return nil, fmt.Errorf("invalid record route %q, expected <record.path>=<value> <dcr immutable id> <stream name> [endpoint]", strings.TrimSpace(definition))
+			}
+			rawPath, pattern, found := strings.Cut(fields[0], "=")
+			if !found {
+				return nil, fmt.Errorf("invalid record route condition %q, expected <record.path>=<value>", fields[0])
+			}
+			recordPath, err := parseRecordPath(rawPath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid path in record route %s", fields[0])
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid value pattern %s", pattern)
+			}
+			route := RecordRoute{
+				Path:         recordPath,
+				ValuePattern: pattern,
+				Destination: Destination{
+					DcrImmutableId: fields[1],
+					StreamName:     fields[2],
+				},
+			}
+			if len(fields) == 4 {
+				route.Destination.Endpoint = fields[3]
+			}
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+func (r RecordRoute) matches(fields *recordFields) bool {
+	raw, ok := fields.lookup(r.Path)
+	if !ok {
+		return false
+	}
+	matched, _ := path.Match(r.ValuePattern, fmt.Sprintf("%v", convertRecordValue(raw)))
+	return matched
+}
+
+// resolveRecordDestination returns the destination of the first record route matching the record.
+// When no record route matches, the destination of the tag is used.
+func (c AzureConfig) resolveRecordDestination(fields *recordFields, tag string) (Destination, bool) {
+	for _, route := range c.RecordRoutes {
+		if route.matches(fields) {
+			destination := route.Destination
+			if destination.Endpoint == "" {
+				destination.Endpoint = c.Endpoint
+			}
+			return destination, true
+		}
+	}
+	return c.resolveDestination(tag)
+}
+
+// routeEndpoints returns the endpoints used by routes and the heartbeat that differ from the endpoint of the output.
+func (c AzureConfig) routeEndpoints() []string {
+	var endpoints []string
+	seen := map[string]bool{c.Endpoint: true, "": true}
+	add := func(endpoint string) {
+		if !seen[endpoint] {
+			seen[endpoint] = true
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	for _, route := range c.Routes {
+		add(route.Destination.Endpoint)
+	}
+	for _, route := range c.RecordRoutes {
+		add(route.Destination.Endpoint)
+	}
+	add(c.Heartbeat.Destination.Endpoint)
+	return endpoints
+}
+
+// Batch is a JSON array of log entries that is uploaded in a single request.
+type Batch struct {
+	Destination Destination
+	Tag         string
+	Payload     []byte
+	// Records is the number of rows in the payload, it is 0 when unknown.
+	Records int
+	// Trace is the span of the flush that created the batch, so its uploads are traced as part of the flush.
+	Trace trace.SpanContext
+}
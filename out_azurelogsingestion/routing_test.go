@@ -0,0 +1,187 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/fluent/fluent-bit-go/out_azurelogsingestion/out_azurelogsingestion/logs"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestParseRoutes_parsesDefinitions(t *testing.T) {
+	routes, err := parseRoutes("kube.* dcr-1 Custom-containers, host.* dcr-2 Custom-syslog https://other.ingest.monitor.azure.com")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Route{
+		{TagPattern: "kube.*", Destination: Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-containers"}},
+		{TagPattern: "host.*", Destination: Destination{DcrImmutableId: "dcr-2", StreamName: "Custom-syslog", Endpoint: "https://other.ingest.monitor.azure.com"}},
+	}, routes)
+}
+
+func TestParseRoutes_invalidDefinitions_returnsError(t *testing.T) {
+	for _, spec := range []string{"kube.* dcr-1", "kube.* dcr-1 stream endpoint extra", "[kube dcr-1 stream"} {
+		_, err := parseRoutes(spec)
+
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestResolveDestination_matchingRoute_usesRouteAndDefaultEndpoint(t *testing.T) {
+	config := AzureConfig{
+		Endpoint:       "https://default",
+		DcrImmutableId: "dcr-default",
+		StreamName:     "Custom-default",
+		Routes: []Route{
+			{TagPattern: "kube.*", Destination: Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-containers"}},
+		},
+	}
+
+	destination, ok := config.resolveDestination("kube.var.log.containers.app.log")
+
+	assert.True(t, ok)
+	assert.Equal(t, Destination{Endpoint: "https://default", DcrImmutableId: "dcr-1", StreamName: "Custom-containers"}, destination)
+}
+
+func TestResolveDestination_noMatchingRoute_usesDefault(t *testing.T) {
+	config := AzureConfig{
+		Endpoint:       "https://default",
+		DcrImmutableId: "dcr-default",
+		StreamName:     "Custom-default",
+		Routes: []Route{
+			{TagPattern: "kube.*", Destination: Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-containers"}},
+		},
+	}
+
+	destination, ok := config.resolveDestination("host.syslog")
+
+	assert.True(t, ok)
+	assert.Equal(t, config.defaultDestination(), destination)
+}
+
+func TestResolveDestination_noMatchingRouteAndNoDefault_returnsFalse(t *testing.T) {
+	config := AzureConfig{
+		Endpoint: "https://default",
+		Routes: []Route{
+			{TagPattern: "kube.*", Destination: Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-containers"}},
+		},
+	}
+
+	_, ok := config.resolveDestination("host.syslog")
+
+	assert.False(t, ok)
+}
+
+func TestParseRecordRoutes_parsesDefinitions(t *testing.T) {
+	routes, err := parseRecordRoutes("kubernetes.namespace_name=tenant-a dcr-1 Custom-tenant-a, kubernetes.labels['app.kubernetes.io/part-of']=system dcr-2 Custom-system https://other")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []RecordRoute{
+		{Path: []string{"kubernetes", "namespace_name"}, ValuePattern: "tenant-a", Destination: Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-tenant-a"}},
+		{Path: []string{"kubernetes", "labels", "app.kubernetes.io/part-of"}, ValuePattern: "system", Destination: Destination{DcrImmutableId: "dcr-2", StreamName: "Custom-system", Endpoint: "https://other"}},
+	}, routes)
+}
+
+func TestParseRecordRoutes_invalidDefinitions_returnsError(t *testing.T) {
+	for _, spec := range []string{"kubernetes.namespace_name dcr-1 stream", "=tenant dcr-1 stream", "level=[ dcr-1 stream", "level=error dcr-1"} {
+		_, err := parseRecordRoutes(spec)
+
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestResolveRecordDestination_matchingRecordRoute_usesRecordRoute(t *testing.T) {
+	config := AzureConfig{
+		Endpoint:       "https://default",
+		DcrImmutableId: "dcr-default",
+		StreamName:     "Custom-default",
+		RecordRoutes: []RecordRoute{
+			{Path: []string{"kubernetes", "namespace_name"}, ValuePattern: "kube-*", Destination: Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-system"}},
+			{Path: []string{"log", "level"}, ValuePattern: "error", Destination: Destination{DcrImmutableId: "dcr-2", StreamName: "Custom-errors"}},
+		},
+	}
+	systemRecord := map[interface{}]interface{}{"kubernetes": map[interface{}]interface{}{"namespace_name": []byte("kube-system")}}
+	errorRecord := map[interface{}]interface{}{"log": `{"level":"error"}`}
+	otherRecord := map[interface{}]interface{}{"log": "message"}
+
+	systemDestination, _ := config.resolveRecordDestination(newRecordFields(systemRecord), "kube.app")
+	errorDestination, _ := config.resolveRecordDestination(newRecordFields(errorRecord), "kube.app")
+	otherDestination, _ := config.resolveRecordDestination(newRecordFields(otherRecord), "kube.app")
+
+	assert.Equal(t, Destination{Endpoint: "https://default", DcrImmutableId: "dcr-1", StreamName: "Custom-system"}, systemDestination)
+	assert.Equal(t, Destination{Endpoint: "https://default", DcrImmutableId: "dcr-2", StreamName: "Custom-errors"}, errorDestination)
+	assert.Equal(t, config.defaultDestination(), otherDestination)
+}
+
+func TestRouteEndpoints_returnsDistinctNonDefaultEndpoints(t *testing.T) {
+	config := AzureConfig{
+		Endpoint: "https://default",
+		Routes: []Route{
+			{Destination: Destination{Endpoint: "https://other"}},
+			{Destination: Destination{}},
+		},
+		RecordRoutes: []RecordRoute{
+			{Destination: Destination{Endpoint: "https://default"}},
+			{Destination: Destination{Endpoint: "https://other"}},
+			{Destination: Destination{Endpoint: "https://third"}},
+		},
+	}
+
+	assert.Equal(t, []string{"https://other", "https://third"}, config.routeEndpoints())
+}
+
+func TestBatchBuilder_batches_splitsPerDestination(t *testing.T) {
+	tenantA := Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-tenant-a"}
+	tenantB := Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-tenant-b"}
+	operator := &AzureOperator{
+		config: AzureConfig{RecordRoutes: []RecordRoute{
+			{Path: []string{"tenant"}, ValuePattern: "a", Destination: tenantA},
+			{Path: []string{"tenant"}, ValuePattern: "b", Destination: tenantB},
+		}},
+		converter: ColumnMapping{{Name: "log", Path: []string{"log"}}},
+	}
+	timestamp := time.Date(2025, 5, 12, 12, 0, 0, 0, time.UTC)
+	builder := newBatchBuilder(operator, "kube.app")
+	builder.add(map[interface{}]interface{}{"tenant": "b", "log": "b1"}, timestamp)
+	builder.add(map[interface{}]interface{}{"tenant": "a", "log": "a1"}, timestamp)
+	builder.add(map[interface{}]interface{}{"tenant": "b", "log": "b2"}, timestamp)
+	builder.add(map[interface{}]interface{}{"tenant": "c", "log": "c1"}, timestamp)
+
+	batches := builder.batches()
+
+	assert.Equal(t, []Batch{
+		{Destination: tenantB, Tag: "kube.app", Payload: []byte(`[{"TimeGenerated":"2025-05-12T12:00:00Z","log":"b1"},{"TimeGenerated":"2025-05-12T12:00:00Z","log":"b2"}]`), Records: 2},
+		{Destination: tenantA, Tag: "kube.app", Payload: []byte(`[{"TimeGenerated":"2025-05-12T12:00:00Z","log":"a1"}]`), Records: 1},
+	}, batches)
+	assert.Equal(t, 1, builder.dropped)
+}
+
+func TestSendLogsTo_routeEndpoint_usesRouteClient(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defaultClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	routeClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	operator := &AzureOperator{
+		config:       AzureConfig{Endpoint: "https://default"},
+		logsClient:   defaultClient,
+		routeClients: map[string]logs.AzureLogsClient{"https://other": routeClient},
+	}
+
+	routeClient.EXPECT().Upload(gomock.Any(), "dcr-2", "Custom-syslog", gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, nil)
+
+	err := operator.SendLogsTo(Destination{Endpoint: "https://other", DcrImmutableId: "dcr-2", StreamName: "Custom-syslog"}, []byte(`[]`))
+	assert.NoError(t, err)
+}
+
+func TestValidateDestinations_requiresDefaultDestinationOrRoute(t *testing.T) {
+	output := Destination{Endpoint: "https://default", DcrImmutableId: "dcr-1", StreamName: "Custom-logs"}
+	routes := []Route{{TagPattern: "kube.*", Destination: Destination{DcrImmutableId: "dcr-2", StreamName: "Custom-kube"}}}
+	recordRoutes := []RecordRoute{{Path: []string{"level"}, ValuePattern: "error", Destination: Destination{DcrImmutableId: "dcr-2", StreamName: "Custom-errors"}}}
+
+	assert.NoError(t, validateDestinations(output, nil, nil))
+	assert.NoError(t, validateDestinations(Destination{Endpoint: "https://default"}, routes, nil))
+	assert.NoError(t, validateDestinations(Destination{Endpoint: "https://default"}, nil, recordRoutes))
+	assert.Error(t, validateDestinations(Destination{Endpoint: "https://default"}, nil, nil))
+	assert.Error(t, validateDestinations(Destination{Endpoint: "https://default", DcrImmutableId: "dcr-1"}, nil, nil))
+}
@@ -0,0 +1,261 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	spoolEvictDropOldest       = "drop_oldest"
+	spoolEvictDropNewest       = "drop_newest"
+	spoolFileSuffix            = ".batch"
+	defaultSpoolMaxBytes       = 1 << 30
+	defaultSpoolReplayInterval = 30 * time.Second
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+// spool stores batches that could not be delivered on disk, one file per batch, and replays them in order.
+type spool struct {
+	dir      string
+	maxBytes int64
+	eviction string
+	mutex    sync.Mutex
+	sequence uint64
+	stop     chan struct{}
+	replays  sync.WaitGroup
+	// evicted is called with the destination and records of every batch that is removed to make room, when it is set.
+	evicted func(Batch)
+	logger  zerolog.Logger
+}
+
+// spoolHeader is stored on the first line of a spool file.
+type spoolHeader struct {
+	Destination
+	Tag     string `json:",omitempty"`
+	Records int    `json:",omitempty"`
+}
+
+type spoolFile struct {
+	path string
+	size int64
+}
+
+func newSpool(dir string, maxBytes int, eviction string) (*spool, error) {
+	switch eviction {
+	case "":
+		eviction = spoolEvictDropOldest
+	case spoolEvictDropOldest, spoolEvictDropNewest:
+	default:
+		return nil, fmt.Errorf("unknown spool eviction %q, expected %s or %s", eviction, spoolEvictDropOldest, spoolEvictDropNewest)
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create spool directory %s", dir)
+	}
+	return &spool{dir: dir, maxBytes: int64(maxBytes), eviction: eviction, logger: log.Logger}, nil
+}
+
+// store writes the batch to a new file in the spool, evicting batches according to the eviction policy when the spool is full.
+func (s *spool) store(batch Batch) error {
+	header, err := json.Marshal(spoolHeader{Destination: batch.Destination, Tag: batch.Tag, Records: batch.Records})
+	if err != nil {
+		return err
+	}
+	content := make([]byte, 0, len(header)+1+len(batch.Payload))
+	content = append(append(append(content, header...), '\n'), batch.Payload...)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.makeRoom(int64(len(content))); err != nil {
+		return err
+	}
+	s.sequence++
+	name := fmt.Sprintf("%020d-%010d%s", time.Now().UnixNano(), s.sequence, spoolFileSuffix)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return errors.Wrap(err, "failed to write spool file")
+	}
+	return errors.Wrap(os.Rename(tmp, filepath.Join(s.dir, name)), "failed to commit spool file")
+}
+
+func (s *spool) makeRoom(size int64) error {
+	if size > s.maxBytes {
+		return errSpoolFull
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+	for len(files) > 0 && total+size > s.maxBytes {
+		if s.eviction == spoolEvictDropNewest {
+			return errSpoolFull
+		}
+		s.logger.Warn().Msgf("[azurelogsingestion] Spool is full, dropping oldest batch %s", files[0].path)
+		header, headerErr := readSpoolHeader(files[0].path)
+		if err := os.Remove(files[0].path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if s.evicted != nil && headerErr == nil {
+			s.evicted(Batch{Destination: header.Destination, Tag: header.Tag, Records: header.Records})
+		}
+		total -= files[0].size
+		files = files[1:]
+	}
+	return nil
+}
+
+// files returns the spooled batches, oldest first.
+func (s *spool) files() ([]spoolFile, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list spool directory")
+	}
+	var files []spoolFile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spoolFileSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, spoolFile{path: filepath.Join(s.dir, entry.Name()), size: info.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files, nil
+}
+
+// replay sends the spooled batches in order and removes them once delivered.
+// It stops at the first failure so the order is kept for the next attempt, except for a batch that Azure rejected
+// permanently, which is kept and skipped so it does not block the batches behind it.
+func (s *spool) replay(send func(Batch) error) (int, error) {
+	s.mutex.Lock()
+	files, err := s.files()
+	s.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, file := range files {
+		content, err := os.ReadFile(file.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return replayed, err
+		}
+		batch, err := decodeSpoolFile(content)
+		if err != nil {
+			s.logger.Err(err).Msgf("[azurelogsingestion] Removing corrupt spool file %s", file.path)
+			_ = os.Remove(file.path)
+			continue
+		}
+		if err := send(batch); err != nil {
+			if isRejected(err) {
+				s.logger.Err(err).Msgf("[azurelogsingestion] Skipping spool file %s that Azure rejected permanently", file.path)
+				continue
+			}
+			return replayed, err
+		}
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+func (s *spool) startReplay(interval time.Duration, send func(Batch) error) {
+	s.stop = make(chan struct{})
+	s.replays.Add(1)
+	go func() {
+		defer s.replays.Done()
+		for {
+			replayed, err := s.replay(send)
+			if replayed > 0 {
+				s.logger.Info().Msgf("[azurelogsingestion] Replayed %d spooled batches", replayed)
+			}
+			if err != nil {
+				s.logger.Err(err).Msg("[azurelogsingestion] Failed to replay spooled batches")
+			}
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// stopReplay stops the background replay and waits for a running replay to finish. Batches can still be stored afterwards.
+func (s *spool) stopReplay() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	s.replays.Wait()
+	s.stop = nil
+}
+
+// readSpoolHeader reads the header of a spool file without reading its payload.
+func readSpoolHeader(path string) (spoolHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return spoolHeader{}, err
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return spoolHeader{}, errors.Wrap(err, "spool file has no destination header")
+	}
+	var header spoolHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return spoolHeader{}, errors.Wrap(err, "invalid destination header")
+	}
+	return header, nil
+}
+
+func decodeSpoolFile(content []byte) (Batch, error) {
+	header, payload, found := bytes.Cut(content, []byte("\n"))
+	if !found {
+		return Batch{}, errors.New("spool file has no destination header")
+	}
+	var decoded spoolHeader
+	if err := json.Unmarshal(header, &decoded); err != nil {
+		return Batch{}, errors.Wrap(err, "invalid destination header")
+	}
+	return Batch{Destination: decoded.Destination, Tag: decoded.Tag, Records: decoded.Records, Payload: payload}, nil
+}
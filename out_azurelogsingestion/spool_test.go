@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+var spoolDestination = Destination{Endpoint: "https://default", DcrImmutableId: "dcr-1", StreamName: "Custom-stream"}
+
+func TestNewSpool_unknownEviction_returnsError(t *testing.T) {
+	_, err := newSpool(t.TempDir(), 0, "drop_everything")
+
+	assert.Error(t, err)
+}
+
+func TestSpool_replay_sendsBatchesInOrderAndRemovesThem(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 0, "")
+	assert.NoError(t, err)
+	for _, payload := range []string{`[{"log":"1"}]`, `[{"log":"2"}]`, `[{"log":"3"}]`} {
+		assert.NoError(t, s.store(Batch{Destination: spoolDestination, Payload: []byte(payload)}))
+	}
+
+	var replayed []Batch
+	count, err := s.replay(func(batch Batch) error {
+		replayed = append(replayed, batch)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, []Batch{
+		{Destination: spoolDestination, Payload: []byte(`[{"log":"1"}]`)},
+		{Destination: spoolDestination, Payload: []byte(`[{"log":"2"}]`)},
+		{Destination: spoolDestination, Payload: []byte(`[{"log":"3"}]`)},
+	}, replayed)
+	files, err := s.files()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSpool_replay_stopsAtFirstFailure(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 0, "")
+	assert.NoError(t, err)
+	assert.NoError(t, s.store(Batch{Destination: spoolDestination, Payload: []byte(`[1]`)}))
+	assert.NoError(t, s.store(Batch{Destination: spoolDestination, Payload: []byte(`[2]`)}))
+
+	count, err := s.replay(func(batch Batch) error {
+		return errors.New("azure unavailable")
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 0, count)
+	files, err := s.files()
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestSpool_replay_skipsRejectedBatch(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 0, "")
+	assert.NoError(t, err)
+	assert.NoError(t, s.store(Batch{Destination: spoolDestination, Payload: []byte(`[1]`)}))
+	assert.NoError(t, s.store(Batch{Destination: spoolDestination, Payload: []byte(`[2]`)}))
+
+	count, err := s.replay(func(batch Batch) error {
+		if string(batch.Payload) == `[1]` {
+			return rejectedError{err: errors.New("failed to dead-letter batch")}
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	files, err := s.files()
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestSpool_replay_removesCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newSpool(dir, 0, "")
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "0-corrupt"+spoolFileSuffix), []byte("no header"), 0600))
+
+	count, err := s.replay(func(batch Batch) error { return nil })
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	files, err := s.files()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSpool_store_dropOldestEvictsOldestBatch(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 400, spoolEvictDropOldest)
+	assert.NoError(t, err)
+	var evicted []Batch
+	s.evicted = func(batch Batch) { evicted = append(evicted, batch) }
+	payload := make([]byte, 60)
+	for idx := range 3 {
+		payload[0] = byte('0' + idx)
+		assert.NoError(t, s.store(Batch{Destination: spoolDestination, Payload: payload, Records: idx + 1}))
+	}
+
+	var replayed []byte
+	_, err = s.replay(func(batch Batch) error {
+		replayed = append(replayed, batch.Payload[0])
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("12"), replayed)
+	assert.Equal(t, []Batch{{Destination: spoolDestination, Records: 1}}, evicted)
+}
+
+func TestSpool_store_dropNewestRejectsBatch(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 400, spoolEvictDropNewest)
+	assert.NoError(t, err)
+	payload := make([]byte, 60)
+	assert.NoError(t, s.store(Batch{Destination: spoolDestination, Payload: payload}))
+	assert.NoError(t, s.store(Batch{Destination: spoolDestination, Payload: payload}))
+
+	err = s.store(Batch{Destination: spoolDestination, Payload: payload})
+
+	assert.ErrorIs(t, err, errSpoolFull)
+}
+
+func TestDeliver_uploadFails_storesBatchInSpool(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	s, err := newSpool(t.TempDir(), 0, "")
+	assert.NoError(t, err)
+	operator := &AzureOperator{config: AzureConfig{Endpoint: spoolDestination.Endpoint}, logsClient: mockClient, spool: s}
+
+	mockClient.EXPECT().Upload(gomock.Any(), "dcr-1", "Custom-stream", gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, errors.New("azure unavailable"))
+
+	err = operator.deliver(Batch{Destination: spoolDestination, Payload: []byte(`[]`)}, true)
+
+	assert.NoError(t, err)
+	files, err := s.files()
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func newSpoolTestOperator(t *testing.T) (*AzureOperator, *mocklogs.MockAzureLogsClient, *spool) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	s, err := newSpool(t.TempDir(), 0, "")
+	assert.NoError(t, err)
+	policy, _ := parseRetryPolicy("", false)
+	operator := &AzureOperator{config: AzureConfig{Endpoint: spoolDestination.Endpoint}, logsClient: mockClient, retryPolicy: policy, spool: s}
+	return operator, mockClient, s
+}
+
+func TestDeliver_earlierAttemptFails_isNotSpooled(t *testing.T) {
+	operator, mockClient, s := newSpoolTestOperator(t)
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(503, nil))
+
+	assert.Error(t, operator.deliver(Batch{Destination: spoolDestination, Payload: []byte(`[]`)}, false))
+	files, err := s.files()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDeliver_throttled_isNotSpooled(t *testing.T) {
+	operator, mockClient, s := newSpoolTestOperator(t)
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(429, nil))
+
+	assert.Error(t, operator.deliver(Batch{Destination: spoolDestination, Payload: []byte(`[]`)}, true))
+	files, err := s.files()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDeliverQueued_spoolsOnceBackoffIsExhausted(t *testing.T) {
+	operator, mockClient, s := newSpoolTestOperator(t)
+	batch := Batch{Destination: spoolDestination, Payload: []byte(`[]`)}
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(503, nil)).Times(2)
+
+	assert.Error(t, operator.deliverQueued(batch, 1))
+	assert.NoError(t, operator.deliverQueued(batch, 5))
+	files, err := s.files()
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestProcessEntries_retriedChunk_spoolsFailedBatch(t *testing.T) {
+	operator, mockClient, s := newSpoolTestOperator(t)
+	operator.uploads = newUploadPool(1)
+	operator.deliveries = newDeliveryTracker(10, time.Hour)
+	chunk := newChunkID("kube.app", []byte("data"))
+
+	mockClient.EXPECT().Upload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, responseError(503, nil)).Times(2)
+
+	assert.Error(t, processEntries(chunk, []Batch{{Destination: spoolDestination, Payload: []byte(`[{"log":"1"}]`)}}, operator))
+	assert.NoError(t, processEntries(chunk, []Batch{{Destination: spoolDestination, Payload: []byte(`[{"log":"1"}]`)}}, operator))
+	files, err := s.files()
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestUpload_endpointNoLongerConfigured_isRejected(t *testing.T) {
+	operator, _, _ := newSpoolTestOperator(t)
+	removed := Destination{Endpoint: "https://removed", DcrImmutableId: "dcr-2", StreamName: "Custom-stream"}
+
+	err := operator.upload(Batch{Destination: removed, Payload: []byte(`[]`)})
+
+	assert.True(t, isRejected(err))
+}
+
+func TestUpload_endpointNoLongerConfigured_isDeadLettered(t *testing.T) {
+	operator, _, _ := newSpoolTestOperator(t)
+	dir := t.TempDir()
+	sink, err := newDeadLetterSink(dir, 0, time.Hour)
+	assert.NoError(t, err)
+	operator.deadLetter = sink
+	removed := Destination{Endpoint: "https://removed", DcrImmutableId: "dcr-2", StreamName: "Custom-stream"}
+
+	assert.NoError(t, operator.upload(Batch{Destination: removed, Payload: []byte(`[]`)}))
+	assert.Len(t, readDeadLetterEntries(t, dir), 1)
+}
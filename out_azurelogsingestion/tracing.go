@@ -0,0 +1,122 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracerName         = "github.com/fluent/fluent-bit-go/out_azurelogsingestion"
+	defaultSampleRatio = 1.0
+
+	spanFlush   = "azurelogsingestion.flush"
+	spanConvert = "azurelogsingestion.convert"
+	spanUpload  = "azurelogsingestion.upload"
+)
+
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// tracingConfig holds the OTLP export settings of an output. Tracing is disabled when no endpoint is configured.
+type tracingConfig struct {
+	Endpoint    string
+	SampleRatio float64
+}
+
+func parseTracingConfig(get func(key string) string) (tracingConfig, error) {
+	config := tracingConfig{Endpoint: get("tracingEndpoint"), SampleRatio: defaultSampleRatio}
+	if value := get("tracingSampleRatio"); value != "" {
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return tracingConfig{}, fmt.Errorf("invalid value for TracingSampleRatio %q, expected a number between 0 and 1", value)
+		}
+		config.SampleRatio = ratio
+	}
+	return config, nil
+}
+
+// newTracerProvider exports the spans of an output with OTLP over HTTP, or returns nil when tracing is disabled.
+// Spans of flushes that are not sampled are not sent, the uploads of a flush follow the decision of the flush.
+func newTracerProvider(config tracingConfig, id int) (*sdktrace.TracerProvider, error) {
+	if config.Endpoint == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(config.Endpoint))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create OTLP exporter for TracingEndpoint %s", config.Endpoint)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "fluent-bit"),
+			attribute.Int("fluentbit.output.instance", id),
+		)),
+	), nil
+}
+
+// tracer returns the tracer of the operator, which does nothing when tracing is disabled.
+func (a *AzureOperator) tracer() trace.Tracer {
+	if a.tracerProvider == nil {
+		return noopTracer
+	}
+	return a.tracerProvider.Tracer(tracerName)
+}
+
+func (a *AzureOperator) shutdownTracing(ctx context.Context) error {
+	if a.tracerProvider == nil {
+		return nil
+	}
+	return a.tracerProvider.Shutdown(ctx)
+}
+
+// endSpan marks the span as failed when err is set and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// responseAttributes returns the HTTP status and Azure request id of an upload. The response is captured for successful uploads,
+// failed uploads carry it in their error.
+func responseAttributes(response *http.Response, err error) []attribute.KeyValue {
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) && responseErr.RawResponse != nil {
+		response = responseErr.RawResponse
+	}
+	if response == nil {
+		return nil
+	}
+	attributes := []attribute.KeyValue{attribute.Int("http.response.status_code", response.StatusCode)}
+	if requestId := response.Header.Get("x-ms-request-id"); requestId != "" {
+		attributes = append(attributes, attribute.String("azure.request_id", requestId))
+	}
+	return attributes
+}
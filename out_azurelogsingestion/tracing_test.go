@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/mock/gomock"
+)
+
+// requestIdTransport responds with the given status and an Azure request id.
+type requestIdTransport int
+
+func (s requestIdTransport) Do(req *http.Request) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("x-ms-request-id", "request-1")
+	return &http.Response{StatusCode: int(s), Header: header, Body: http.NoBody, Request: req}, nil
+}
+
+func withRecordedSpans(operator *AzureOperator) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	operator.tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return exporter
+}
+
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, attr := range span.Attributes {
+		attributes[attr.Key] = attr.Value
+	}
+	return attributes
+}
+
+func TestParseTracingConfig_sampleRatio(t *testing.T) {
+	config, err := parseTracingConfig(authKeys(map[string]string{"tracingEndpoint": "http://collector:4318"}))
+	assert.NoError(t, err)
+	assert.Equal(t, tracingConfig{Endpoint: "http://collector:4318", SampleRatio: 1}, config)
+
+	config, err = parseTracingConfig(authKeys(map[string]string{"tracingSampleRatio": "0.25"}))
+	assert.NoError(t, err)
+	assert.Equal(t, 0.25, config.SampleRatio)
+
+	for _, invalid := range []string{"abc", "-0.1", "1.5"} {
+		_, err = parseTracingConfig(authKeys(map[string]string{"tracingSampleRatio": invalid}))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNewTracerProvider_noEndpoint_disablesTracing(t *testing.T) {
+	provider, err := newTracerProvider(tracingConfig{SampleRatio: 1}, 0)
+
+	assert.NoError(t, err)
+	assert.Nil(t, provider)
+	assert.Equal(t, noopTracer, (&AzureOperator{}).tracer())
+}
+
+func TestSend_upload_recordsStatusAndRequestId(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusInternalServerError} {
+		client, err := constructClient("https://dummy.ingest.monitor.azure.com", &recordingCredential{},
+			azcore.ClientOptions{Transport: requestIdTransport(status), Retry: policy.RetryOptions{MaxRetries: -1}})
+		assert.NoError(t, err)
+		operator := &AzureOperator{logsClient: client}
+		exporter := withRecordedSpans(operator)
+
+		err = operator.send(Batch{Destination: Destination{DcrImmutableId: "dcr-1", StreamName: "Custom-logs"}, Payload: []byte(`[{"log":"1"}]`), Records: 1})
+
+		spans := exporter.GetSpans()
+		assert.Len(t, spans, 1)
+		assert.Equal(t, spanUpload, spans[0].Name)
+		attributes := spanAttributes(spans[0])
+		assert.Equal(t, int64(status), attributes["http.response.status_code"].AsInt64())
+		assert.Equal(t, "request-1", attributes["azure.request_id"].AsString())
+		assert.Equal(t, "Custom-logs", attributes["azure.stream_name"].AsString())
+		assert.Equal(t, int64(13), attributes["azurelogsingestion.batch.bytes"].AsInt64())
+		assert.Equal(t, int64(1), attributes["azurelogsingestion.records"].AsInt64())
+		if status == http.StatusNoContent {
+			assert.NoError(t, err)
+			assert.Equal(t, codes.Unset, spans[0].Status.Code)
+		} else {
+			assert.Error(t, err)
+			assert.Equal(t, codes.Error, spans[0].Status.Code)
+		}
+	}
+}
+
+func TestFlushInstance_tracing_uploadsAreChildrenOfFlush(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	operator := newTestOperator(mockClient, "Custom-logs")
+	exporter := withRecordedSpans(operator)
+	id := azureLogOperators.register(operator)
+	defer exitInstance(id)
+	mockClient.EXPECT().Upload(gomock.Any(), "dcr-1", "Custom-logs", gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, nil)
+
+	assert.Equal(t, output.FLB_OK, flushChunk(id, encodeChunk(t, "first", "second")))
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	assert.Len(t, spans, 3)
+	flush := spans[spanFlush]
+	assert.Equal(t, "kube.app", spanAttributes(flush)["fluentbit.tag"].AsString())
+	assert.Equal(t, flush.SpanContext.SpanID(), spans[spanConvert].Parent.SpanID())
+	assert.Equal(t, int64(2), spanAttributes(spans[spanConvert])["azurelogsingestion.records"].AsInt64())
+	assert.Equal(t, int64(1), spanAttributes(spans[spanConvert])["azurelogsingestion.batches"].AsInt64())
+	assert.Equal(t, flush.SpanContext.SpanID(), spans[spanUpload].Parent.SpanID())
+	assert.Equal(t, flush.SpanContext.TraceID(), spans[spanUpload].SpanContext.TraceID())
+	assert.Equal(t, int64(2), spanAttributes(spans[spanUpload])["azurelogsingestion.records"].AsInt64())
+}
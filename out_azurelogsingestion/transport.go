@@ -0,0 +1,141 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDialTimeout = 30 * time.Second
+	dialKeepAlive      = 30 * time.Second
+)
+
+// transportConfig holds the settings of the HTTP transport used for the token and upload requests of an output.
+type transportConfig struct {
+	httpsProxy         *url.URL
+	rootCAs            *x509.CertPool
+	minTLSVersion      uint16
+	dialTimeout        time.Duration
+	responseTimeout    time.Duration
+	maxConnsPerHost    int
+	maxIdleConnections int
+}
+
+// parseTransportConfig reads the HTTP keys of an output using get.
+func parseTransportConfig(get func(key string) string) (transportConfig, error) {
+	config := transportConfig{minTLSVersion: tls.VersionTLS12}
+	if proxy := get("httpsProxy"); proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+			return transportConfig{}, fmt.Errorf("invalid value for HttpsProxy, expected an http:// or https:// URL")
+		}
+		config.httpsProxy = proxyURL
+	}
+	if caFile := get("caFile"); caFile != "" {
+		rootCAs, err := loadRootCAs(caFile)
+		if err != nil {
+			return transportConfig{}, err
+		}
+		config.rootCAs = rootCAs
+	}
+	switch version := get("tlsMinVersion"); version {
+	case "", "1.2":
+		config.minTLSVersion = tls.VersionTLS12
+	case "1.3":
+		config.minTLSVersion = tls.VersionTLS13
+	default:
+		return transportConfig{}, fmt.Errorf("invalid value %q for TlsMinVersion, expected 1.2 or 1.3", version)
+	}
+	var err error
+	config.dialTimeout, err = parseDuration(get("dialTimeout"), defaultDialTimeout)
+	if err != nil {
+		return transportConfig{}, errors.Wrap(err, "invalid value for DialTimeout")
+	}
+	config.responseTimeout, err = parseDuration(get("responseTimeout"), 0)
+	if err != nil {
+		return transportConfig{}, errors.Wrap(err, "invalid value for ResponseTimeout")
+	}
+	config.maxConnsPerHost, err = parsePositiveInt(get("maxConnectionsPerHost"), 0)
+	if err != nil {
+		return transportConfig{}, errors.Wrap(err, "invalid value for MaxConnectionsPerHost")
+	}
+	config.maxIdleConnections, err = parsePositiveInt(get("maxIdleConnections"), 0)
+	if err != nil {
+		return transportConfig{}, errors.Wrap(err, "invalid value for MaxIdleConnections")
+	}
+	return config, nil
+}
+
+// loadRootCAs returns the system certificates together with the certificates in caFile, for proxies or gateways that inspect TLS.
+func loadRootCAs(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CaFile %s", caFile)
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CaFile %s contains no PEM certificates", caFile)
+	}
+	return rootCAs, nil
+}
+
+// newHTTPClient returns the client used for the token and upload requests of an operator.
+// Every operator has its own transport, so its connections can be released when it is closed.
+func newHTTPClient(config transportConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.httpsProxy != nil {
+		// Like HTTPS_PROXY, the proxy is only used for https requests, so the managed identity endpoint is reached directly.
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if req.URL.Scheme == "https" {
+				return config.httpsProxy, nil
+			}
+			return http.ProxyFromEnvironment(req)
+		}
+	}
+	if config.dialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: config.dialTimeout, KeepAlive: dialKeepAlive}).DialContext
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: config.rootCAs, MinVersion: config.minTLSVersion}
+	transport.ResponseHeaderTimeout = config.responseTimeout
+	transport.MaxConnsPerHost = config.maxConnsPerHost
+	if config.maxIdleConnections > 0 {
+		transport.MaxIdleConns = config.maxIdleConnections
+		transport.MaxIdleConnsPerHost = config.maxIdleConnections
+	}
+	return &http.Client{Transport: transport}
+}
+
+// String leaves the CA certificates and the proxy password out when the configuration is logged.
+func (c transportConfig) String() string {
+	proxy := ""
+	if c.httpsProxy != nil {
+		proxy = c.httpsProxy.Redacted()
+	}
+	return fmt.Sprintf("{HttpsProxy:%s CaFile:%t TlsMinVersion:%s DialTimeout:%s ResponseTimeout:%s MaxConnectionsPerHost:%d MaxIdleConnections:%d}",
+		proxy, c.rootCAs != nil, tls.VersionName(c.minTLSVersion), c.dialTimeout, c.responseTimeout, c.maxConnsPerHost, c.maxIdleConnections)
+}
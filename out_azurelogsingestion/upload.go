@@ -0,0 +1,62 @@
+// Copyright 2025 Niels Claeys
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultWorkers = 1
+
+// uploadPool limits the number of concurrent uploads of an operator.
+// The limit is shared between all flushes of the operator.
+type uploadPool struct {
+	slots chan struct{}
+}
+
+func newUploadPool(workers int) *uploadPool {
+	if workers < 1 {
+		workers = defaultWorkers
+	}
+	return &uploadPool{slots: make(chan struct{}, workers)}
+}
+
+// upload sends all batches using at most the configured number of workers and returns the errors of all failed batches.
+// Once a batch fails, the remaining batches are not started as fluent-bit will retry the whole chunk.
+func (p *uploadPool) upload(batches []Batch, send func(Batch) error) error {
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	errs := make([]error, len(batches))
+	for idx, batch := range batches {
+		p.slots <- struct{}{}
+		if failed.Load() {
+			<-p.slots
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-p.slots }()
+			if err := send(batch); err != nil {
+				errs[idx] = err
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
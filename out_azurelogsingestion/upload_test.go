@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/monitor/ingestion/azlogs"
+	mocklogs "github.com/fluent/fluent-bit-go/out_azurelogsingestion/mocks/azlogs/mock_logsclient"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestUploadPool_upload_neverExceedsWorkers(t *testing.T) {
+	pool := newUploadPool(3)
+	var inFlight, maxInFlight atomic.Int32
+	var mutex sync.Mutex
+	var sent []string
+	batches := make([]Batch, 20)
+	for idx := range batches {
+		batches[idx] = Batch{Payload: []byte{byte('a' + idx)}}
+	}
+
+	err := pool.upload(batches, func(batch Batch) error {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			previous := maxInFlight.Load()
+			if current <= previous || maxInFlight.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		mutex.Lock()
+		sent = append(sent, string(batch.Payload))
+		mutex.Unlock()
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, sent, len(batches))
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(3))
+	assert.Greater(t, maxInFlight.Load(), int32(1))
+}
+
+func TestUploadPool_upload_singleWorkerStopsAtFirstError(t *testing.T) {
+	pool := newUploadPool(1)
+	uploadErr := errors.New("upload failed")
+	calls := 0
+
+	err := pool.upload([]Batch{{}, {}, {}}, func(batch Batch) error {
+		calls++
+		return uploadErr
+	})
+
+	assert.ErrorIs(t, err, uploadErr)
+	assert.Equal(t, 1, calls)
+}
+
+func TestUploadPool_upload_aggregatesErrors(t *testing.T) {
+	pool := newUploadPool(2)
+	firstErr := errors.New("first failed")
+	secondErr := errors.New("second failed")
+	start := make(chan struct{})
+
+	err := pool.upload([]Batch{{Payload: []byte("1")}, {Payload: []byte("2")}}, func(batch Batch) error {
+		if string(batch.Payload) == "1" {
+			<-start
+			return firstErr
+		}
+		close(start)
+		return secondErr
+	})
+
+	assert.ErrorIs(t, err, firstErr)
+	assert.ErrorIs(t, err, secondErr)
+}
+
+func TestProcessEntries_uploadsAllBatches(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mocklogs.NewMockAzureLogsClient(ctrl)
+	operator := &AzureOperator{
+		logsClient: mockClient,
+		uploads:    newUploadPool(4),
+	}
+	destination := Destination{DcrImmutableId: "test-id", StreamName: "test-stream"}
+
+	mockClient.EXPECT().Upload(gomock.Any(), "test-id", "test-stream", gomock.Any(), gomock.Any()).Return(azlogs.UploadResponse{}, nil).Times(5)
+
+	err := processEntries(chunkID{}, []Batch{{Destination: destination}, {Destination: destination}, {Destination: destination}, {Destination: destination}, {Destination: destination}}, operator)
+	assert.NoError(t, err)
+}
+
+func TestParsePositiveInt(t *testing.T) {
+	value, err := parsePositiveInt("", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, value)
+
+	value, err = parsePositiveInt("8", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, value)
+
+	_, err = parsePositiveInt("0", 1)
+	assert.Error(t, err)
+
+	_, err = parsePositiveInt("many", 1)
+	assert.Error(t, err)
+}